@@ -5,7 +5,10 @@ import (
 
 	"emoji-maker-backend/config"
 	"emoji-maker-backend/models"
+	"emoji-maker-backend/providers"
+	"emoji-maker-backend/repositories"
 	"emoji-maker-backend/routes"
+	"emoji-maker-backend/services"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -19,21 +22,73 @@ func main() {
 	config.LoadConfig()
 
 	// 初始化SQLite数据库，使用纯Go的SQLite驱动
-	engine, err := xorm.NewEngine("sqlite", "./users.db")
+	// 后台协程会并发写入任务，设置忙等待超时，避免并发写入时直接返回SQLITE_BUSY
+	engine, err := xorm.NewEngine("sqlite", "./users.db?_pragma=busy_timeout(5000)")
 	if err != nil {
 		panic(err)
 	}
 	defer engine.Close()
 
 	// 同步数据库表结构
-	err = engine.Sync2(new(models.User))
+	err = engine.Sync2(new(models.User), new(models.Job), new(models.WebhookDelivery), new(models.JobBatch), new(models.JobTransition), new(models.UsageRecord))
 	if err != nil {
 		panic(err)
 	}
 
+	// 任务取消器和事件中心在请求处理器和后台服务之间共享
+	jobCanceler := services.NewJobCanceler()
+	jobEvents := services.NewJobEventBroker()
+
+	// 视频生成服务，提交、查询和取消上游任务都通过它完成，由配置选择DashScope或本地模拟服务
+	videoProvider, err := providers.NewVideoProvider()
+	if err != nil {
+		panic(err)
+	}
+
+	// 文本模型客户端，用于处理提示词
+	chatClient := providers.NewChatClient()
+
+	// 可用的视频和文本模型目录
+	modelCatalog := services.NewModelCatalog()
+
+	// 任务的每次写入都会发布状态事件，供SSE接口推送
+	jobRepo := services.NewPublishingJobRepository(repositories.NewXormJobRepository(engine), jobEvents)
+
+	// 上游调用的用量记录，用于统计每个用户的费用
+	usageRepo := repositories.NewXormUsageRepository(engine)
+
+	// 任务结束时向回调地址投递结果
+	deliveryRepo := repositories.NewXormWebhookDeliveryRepository(engine)
+	webhookDispatcher := services.NewWebhookDispatcher(deliveryRepo)
+	jobEvents.AddListener(webhookDispatcher.Dispatch)
+	defer webhookDispatcher.Stop()
+
+	// 启动任务提交调度器，按用户轮转公平地提交任务，并限制全局和每个用户进行中的任务数
+	jobScheduler := services.NewJobScheduler(jobRepo, videoProvider, jobCanceler)
+	jobEvents.AddListener(jobScheduler.Observe)
+
+	// 恢复上次退出时未结束的任务，避免任务永远停留在进行中
+	if err := services.RecoverJobs(jobRepo, jobScheduler); err != nil {
+		log.Printf("恢复未结束的任务失败: %v", err)
+	}
+	jobScheduler.Start()
+	defer jobScheduler.Stop()
+
+	// 启动后台任务轮询器，负责推进上游任务、记录视频用量并转换GIF
+	jobWorker := services.NewJobWorker(jobRepo, usageRepo, videoProvider, modelCatalog, jobCanceler)
+	jobWorker.Start()
+	defer jobWorker.Stop()
+
+	// 启动任务目录的定期清理
+	retentionService := services.NewRetentionService(jobRepo)
+	retentionService.Start()
+	defer retentionService.Stop()
+
 	// 创建fiber应用实例
+	// 请求体需要容纳最大的输入图片，Base64编码的图片比原文件大约三分之一，另外为其他表单字段预留1MB
 	app := fiber.New(fiber.Config{
-		AppName: "Emoji Maker Backend",
+		AppName:   "Emoji Maker Backend",
+		BodyLimit: int(services.MaxInputImageBytes()*4/3) + 1024*1024,
 	})
 
 	// 添加中间件
@@ -41,7 +96,7 @@ func main() {
 	app.Use(cors.New())
 
 	// 设置路由
-	setupRoutes(app, engine)
+	setupRoutes(app, engine, jobRepo, deliveryRepo, usageRepo, jobCanceler, jobEvents, jobScheduler, videoProvider, modelCatalog, chatClient)
 
 	// 设置静态文件服务
 	app.Static("/tasks", "./tasks")
@@ -50,9 +105,12 @@ func main() {
 	log.Fatal(app.ListenTLS(":"+config.AppConfig.Server.Port, "cert.pem", "key.pem"))
 }
 
-func setupRoutes(app *fiber.App, engine *xorm.Engine) {
+func setupRoutes(app *fiber.App, engine *xorm.Engine, jobRepo repositories.JobRepository, deliveryRepo repositories.WebhookDeliveryRepository, usageRepo repositories.UsageRepository, jobCanceler services.JobCanceler, jobEvents services.JobEventBroker, jobScheduler services.JobScheduler, videoProvider providers.VideoProvider, modelCatalog services.ModelCatalog, chatClient providers.ChatClient) {
 	// 设置视频相关路由
-	routes.SetupVideoRoutes(app)
+	routes.SetupVideoRoutes(app, jobRepo, deliveryRepo, repositories.NewXormJobBatchRepository(engine), jobCanceler, jobEvents, jobScheduler, videoProvider, modelCatalog, chatClient, usageRepo)
+
+	// 设置用量统计相关路由
+	routes.SetupUsageRoutes(app, usageRepo)
 
 	// 设置用户相关路由
 	routes.SetupUserRoutes(app, engine)
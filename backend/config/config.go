@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -15,6 +17,87 @@ type Config struct {
 		Port string `mapstructure:"port"`
 		Host string `mapstructure:"host"`
 	} `mapstructure:"server"`
+	Provider struct {
+		Name  string `mapstructure:"name"` // 视频生成服务: dashscope 或 local(本地模拟，不需要密钥和外网)
+		Local struct {
+			Delay       time.Duration `mapstructure:"delay"`        // 模拟任务从提交到生成完成的时间
+			FailureRate float64       `mapstructure:"failure_rate"` // 模拟任务生成失败的概率，取值0到1
+		} `mapstructure:"local"`
+	} `mapstructure:"provider"`
+	Upstream struct {
+		Timeout          time.Duration `mapstructure:"timeout"`           // 单次调用视频生成服务的超时时间
+		MaxAttempts      int           `mapstructure:"max_attempts"`      // 遇到网络错误、429和5xx时最多调用的次数(含首次)
+		InitialBackoff   time.Duration `mapstructure:"initial_backoff"`   // 首次重试前的最长等待时间，之后每次翻倍
+		MaxBackoff       time.Duration `mapstructure:"max_backoff"`       // 单次重试等待时间的上限，上游返回Retry-After时以其为准
+		BreakerThreshold int           `mapstructure:"breaker_threshold"` // 连续失败多少次后熔断，0表示不熔断
+		BreakerCooldown  time.Duration `mapstructure:"breaker_cooldown"`  // 熔断持续时间，期间的调用直接失败
+	} `mapstructure:"upstream"`
+	Chat struct {
+		BaseURL string        `mapstructure:"base_url"` // OpenAI兼容的文本模型接口地址，默认为DashScope兼容模式
+		Timeout time.Duration `mapstructure:"timeout"`  // 单次请求的超时时间，流式请求包含读取全部内容的时间，重试和熔断参数与upstream相同
+	} `mapstructure:"chat"`
+	Worker struct {
+		PollInterval    time.Duration `mapstructure:"poll_interval"`     // 轮询上游任务状态的间隔
+		Concurrency     int           `mapstructure:"concurrency"`       // 并发处理任务的工作协程数
+		DownloadTimeout time.Duration `mapstructure:"download_timeout"`  // 下载生成视频的超时时间
+		ConvertTimeout  time.Duration `mapstructure:"convert_timeout"`   // 转换GIF的超时时间，包含生成调色板和转换两次ffmpeg调用
+		MaxPollFailures int           `mapstructure:"max_poll_failures"` // 连续查询上游状态失败达到该次数后将任务标记为失败
+	} `mapstructure:"worker"`
+	Queue struct {
+		MaxConcurrent int `mapstructure:"max_concurrent"` // 同时提交到视频生成服务并处理中的任务数上限
+		MaxPerUser    int `mapstructure:"max_per_user"`   // 每个用户同时处理中的任务数上限，超出的任务保持PENDING排队
+	} `mapstructure:"queue"`
+	Retention struct {
+		Interval       time.Duration `mapstructure:"interval"`          // 清理间隔
+		MaxAge         time.Duration `mapstructure:"max_age"`           // 任务及GIF的最长保留时间，0表示不限制
+		MaxJobsPerUser int           `mapstructure:"max_jobs_per_user"` // 每个用户最多保留的已结束任务数，0表示不限制
+		MaxDiskMB      int64         `mapstructure:"max_disk_mb"`       // tasks目录的磁盘预算(MB)，0表示不限制
+		TempFileMaxAge time.Duration `mapstructure:"temp_file_max_age"` // 超过该时间的临时文件视为转换中断遗留
+	} `mapstructure:"retention"`
+	Webhook struct {
+		Secret            string        `mapstructure:"secret"`              // 回调签名使用的HMAC密钥
+		MaxAttempts       int           `mapstructure:"max_attempts"`        // 最多投递次数(含首次)
+		InitialBackoff    time.Duration `mapstructure:"initial_backoff"`     // 首次重试前的等待时间，之后每次翻倍
+		Timeout           time.Duration `mapstructure:"timeout"`             // 单次投递的超时时间
+		AllowPrivateHosts bool          `mapstructure:"allow_private_hosts"` // 是否允许回调到回环、内网和链路本地地址，仅用于本地开发和测试
+	} `mapstructure:"webhook"`
+	Idempotency struct {
+		Window time.Duration `mapstructure:"window"` // 同一幂等键在该时间内重复提交时返回原任务
+	} `mapstructure:"idempotency"`
+	Upload struct {
+		Dir          string `mapstructure:"dir"`            // 图生视频输入图片的保存目录，不通过静态文件服务公开
+		MaxImageMB   int64  `mapstructure:"max_image_mb"`   // 输入图片的最大体积(MB)
+		MinImageSide int    `mapstructure:"min_image_side"` // 输入图片宽和高的最小值(像素)
+		MaxImageSide int    `mapstructure:"max_image_side"` // 输入图片宽和高的最大值(像素)，提交前会缩小到分辨率档位的尺寸
+		MaxImageMP   int    `mapstructure:"max_image_mp"`   // 输入图片的最大像素数(百万)，限制解码图片占用的内存
+		Concurrency  int    `mapstructure:"concurrency"`    // 同时预处理的图片数上限，超出的请求等待
+	} `mapstructure:"upload"`
+	Admin struct {
+		UserIDs []int64 `mapstructure:"user_ids"` // 可以访问管理接口(例如全站用量统计)的用户ID
+	} `mapstructure:"admin"`
+	Models struct {
+		Video []VideoModel `mapstructure:"video"` // 可用的视频模型
+		Text  []TextModel  `mapstructure:"text"`  // 可用的文本模型，用于处理提示词
+	} `mapstructure:"models"`
+}
+
+// VideoModel 模型目录中的视频模型及其能力
+type VideoModel struct {
+	Name          string   `mapstructure:"name" json:"name"`
+	Capabilities  []string `mapstructure:"capabilities" json:"capabilities"`         // 支持的生成方式: t2v(文生视频)、i2v(图生视频)
+	Sizes         []string `mapstructure:"sizes" json:"sizes,omitempty"`             // 文生视频可用的分辨率，格式为 宽*高
+	Resolutions   []string `mapstructure:"resolutions" json:"resolutions,omitempty"` // 图生视频可用的分辨率档位
+	MaxDuration   int      `mapstructure:"max_duration" json:"max_duration"`         // 视频最长时长(秒)
+	CostPerSecond float64  `mapstructure:"cost_per_second" json:"cost_per_second"`   // 每秒视频的价格(元)
+	Default       bool     `mapstructure:"default" json:"default"`                   // 是否为所支持生成方式的默认模型
+}
+
+// TextModel 模型目录中的文本模型
+type TextModel struct {
+	Name            string  `mapstructure:"name" json:"name"`
+	Search          bool    `mapstructure:"search" json:"search"`                         // 是否支持联网搜索
+	CostPer1KTokens float64 `mapstructure:"cost_per_1k_tokens" json:"cost_per_1k_tokens"` // 每千个token的价格(元)
+	Default         bool    `mapstructure:"default" json:"default"`                       // 是否为默认模型
 }
 
 var AppConfig Config
@@ -23,6 +106,68 @@ func LoadConfig() {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
+
+	// 默认值
+	viper.SetDefault("provider.name", "dashscope")
+	viper.SetDefault("provider.local.delay", "10s")
+	viper.SetDefault("upstream.timeout", "30s")
+	viper.SetDefault("upstream.max_attempts", 3)
+	viper.SetDefault("upstream.initial_backoff", "500ms")
+	viper.SetDefault("upstream.max_backoff", "10s")
+	viper.SetDefault("upstream.breaker_threshold", 5)
+	viper.SetDefault("upstream.breaker_cooldown", "30s")
+	viper.SetDefault("chat.base_url", "https://dashscope.aliyuncs.com/compatible-mode/v1")
+	viper.SetDefault("chat.timeout", "60s")
+	viper.SetDefault("worker.poll_interval", "5s")
+	viper.SetDefault("worker.concurrency", 4)
+	viper.SetDefault("worker.download_timeout", "2m")
+	viper.SetDefault("worker.convert_timeout", "2m")
+	viper.SetDefault("worker.max_poll_failures", 10)
+	viper.SetDefault("queue.max_concurrent", 4)
+	viper.SetDefault("queue.max_per_user", 2)
+	viper.SetDefault("retention.interval", "1h")
+	viper.SetDefault("retention.max_age", "720h")
+	viper.SetDefault("retention.max_jobs_per_user", 500)
+	viper.SetDefault("retention.max_disk_mb", 2048)
+	viper.SetDefault("retention.temp_file_max_age", "1h")
+	viper.SetDefault("webhook.max_attempts", 5)
+	viper.SetDefault("webhook.initial_backoff", "2s")
+	viper.SetDefault("webhook.timeout", "10s")
+	viper.SetDefault("webhook.allow_private_hosts", false)
+	viper.SetDefault("idempotency.window", "24h")
+	viper.SetDefault("upload.dir", "artifacts")
+	viper.SetDefault("upload.max_image_mb", 10)
+	viper.SetDefault("upload.min_image_side", 360)
+	viper.SetDefault("upload.max_image_side", 8192)
+	viper.SetDefault("upload.max_image_mp", 40)
+	viper.SetDefault("upload.concurrency", 2)
+	viper.SetDefault("models.video", []map[string]interface{}{
+		{
+			"name":            "wanx2.1-t2v-turbo",
+			"capabilities":    []string{"t2v"},
+			"sizes":           []string{"832*480", "480*832", "624*624", "1280*720", "720*1280", "960*960", "1088*832", "832*1088"},
+			"max_duration":    5,
+			"cost_per_second": 0.24,
+			"default":         true,
+		},
+		{
+			"name":            "wan2.2-i2v-flash",
+			"capabilities":    []string{"i2v"},
+			"resolutions":     []string{"480P", "720P"},
+			"max_duration":    5,
+			"cost_per_second": 0.1,
+			"default":         true,
+		},
+	})
+	viper.SetDefault("models.text", []map[string]interface{}{
+		{
+			"name":               "qwen-flash",
+			"search":             true,
+			"cost_per_1k_tokens": 0.0003,
+			"default":            true,
+		},
+	})
+
 	err := viper.ReadInConfig()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"emoji-maker-backend/repositories"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// usageDateLayout 用量查询参数的日期格式
+	usageDateLayout = "2006-01-02"
+	// defaultUsageDays 未指定起始日期时查询的天数
+	defaultUsageDays = 30
+	// maxUsageDays 单次查询的最大天数
+	maxUsageDays = 366
+)
+
+// 当前用户的用量响应
+type UserUsageResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	Data    struct {
+		From  string                     `json:"from"`
+		To    string                     `json:"to"`
+		Total *repositories.UsageTotal   `json:"total"`
+		Daily []*repositories.UsageTotal `json:"daily"` // 只包含有用量的日期
+	} `json:"data"`
+}
+
+// 按用户汇总的用量响应
+type UsageByUserResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	Data    struct {
+		From  string                     `json:"from"`
+		To    string                     `json:"to"`
+		Users []*repositories.UsageTotal `json:"users"` // 费用最高的用户在前
+	} `json:"data"`
+}
+
+// 按天汇总的用量响应
+type UsageByDayResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	Data    struct {
+		From  string                     `json:"from"`
+		To    string                     `json:"to"`
+		Daily []*repositories.UsageTotal `json:"daily"`
+	} `json:"data"`
+}
+
+// UsageHandler 用量统计处理器
+type UsageHandler struct {
+	usageRepo repositories.UsageRepository
+}
+
+// NewUsageHandler 创建用量统计处理器实例
+func NewUsageHandler(usageRepo repositories.UsageRepository) *UsageHandler {
+	return &UsageHandler{usageRepo: usageRepo}
+}
+
+// usageRange 解析from和to查询参数(包含两端的日期)，返回查询使用的左闭右开时间区间
+// 不指定时查询截止到今天的最近30天
+func usageRange(c *fiber.Ctx) (time.Time, time.Time, error) {
+	now := time.Now()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.ParseInLocation(usageDateLayout, value, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid to date, expected format %s", usageDateLayout)
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, 1-defaultUsageDays)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.ParseInLocation(usageDateLayout, value, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid from date, expected format %s", usageDateLayout)
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must not be after to")
+	}
+	if from.AddDate(0, 0, maxUsageDays).Before(to.AddDate(0, 0, 1)) {
+		return time.Time{}, time.Time{}, fmt.Errorf("Date range must not exceed %d days", maxUsageDays)
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// GetUserUsage 查询当前用户的用量和估算费用，包含总计和每天的明细
+func (h *UsageHandler) GetUserUsage(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(int64)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID in token",
+		})
+	}
+
+	from, to, err := usageRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	total, err := h.usageRepo.Total(userID, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load usage"})
+	}
+	daily, err := h.usageRepo.TotalByDay(userID, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load usage"})
+	}
+
+	response := UserUsageResponse{
+		Code: 200,
+	}
+	response.Data.From = from.Format(usageDateLayout)
+	response.Data.To = to.AddDate(0, 0, -1).Format(usageDateLayout)
+	response.Data.Total = total
+	response.Data.Daily = daily
+	return c.JSON(response)
+}
+
+// GetUsageByUser 按用户汇总所有用户的用量，仅管理员可用
+func (h *UsageHandler) GetUsageByUser(c *fiber.Ctx) error {
+	from, to, err := usageRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	users, err := h.usageRepo.TotalByUser(from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load usage"})
+	}
+
+	response := UsageByUserResponse{
+		Code: 200,
+	}
+	response.Data.From = from.Format(usageDateLayout)
+	response.Data.To = to.AddDate(0, 0, -1).Format(usageDateLayout)
+	response.Data.Users = users
+	return c.JSON(response)
+}
+
+// GetUsageByDay 按天汇总所有用户或指定用户的用量，仅管理员可用
+func (h *UsageHandler) GetUsageByDay(c *fiber.Ctx) error {
+	from, to, err := usageRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID := int64(c.QueryInt("user_id"))
+	if userID < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user_id"})
+	}
+
+	daily, err := h.usageRepo.TotalByDay(userID, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load usage"})
+	}
+
+	response := UsageByDayResponse{
+		Code: 200,
+	}
+	response.Data.From = from.Format(usageDateLayout)
+	response.Data.To = to.AddDate(0, 0, -1).Format(usageDateLayout)
+	response.Data.Daily = daily
+	return c.JSON(response)
+}
@@ -1,39 +1,51 @@
 package controllers
 
 import (
+	"bufio"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
-	"os/exec"
-	"strings"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"emoji-maker-backend/config"
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/providers"
+	"emoji-maker-backend/repositories"
+	"emoji-maker-backend/services"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-// 任务状态枚举
-const (
-	TaskPending   = "PENDING"
-	TaskRunning   = "RUNNING"
-	TaskSucceeded = "SUCCEEDED"
-	TaskFailed    = "FAILED"
-	TaskUnknown   = "UNKNOWN"
-)
-
 // 视频生成请求体
 type VideoCreateRequest struct {
-	ImgBase64      string `json:"img_base64"`      // 图片Base64编码 (图生视频)
-	Type           string `json:"type"`            // 生成类型: text_to_video 或 image_to_video
-	Prompt         string `json:"prompt"`          // 核心描述文本
-	NegativePrompt string `json:"negative_prompt"` // 反向提示词
-	Size           string `json:"size"`            // 视频分辨率 (文生视频)
-	Resolution     string `json:"resolution"`      // 视频分辨率档位 (图生视频)
+	Image          *services.InputImage `json:"image,omitempty"` // 图生视频的输入图片，来自上传的image文件或img_base64字段，已完成预处理
+	AspectRatio    string               `json:"aspect_ratio"`    // 图生视频的画面比例 (可选)，不传时选择与图片最接近的比例
+	Fit            string               `json:"fit"`             // 图片适配画面比例的方式 (可选): crop 或 pad
+	Type           string               `json:"type"`            // 生成类型: text_to_video 或 image_to_video
+	Prompt         string               `json:"prompt"`          // 核心描述文本
+	NegativePrompt string               `json:"negative_prompt"` // 反向提示词
+	Size           string               `json:"size"`            // 视频分辨率 (文生视频)
+	Resolution     string               `json:"resolution"`      // 视频分辨率档位 (图生视频)
+	CallbackURL    string               `json:"callback_url"`    // 任务结束时回调的地址 (可选)
+	Model          string               `json:"model"`           // 视频模型 (可选)，不传时使用该生成方式的默认模型
+	GenerationParams
+}
+
+// 模型目录响应
+type ListModelsResponse struct {
+	Code int `json:"code"`
+	Data struct {
+		Video []config.VideoModel `json:"video"`
+		Text  []config.TextModel  `json:"text"`
+	} `json:"data"`
 }
 
 // 创建任务响应
@@ -41,185 +53,390 @@ type CreateTaskResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 	Data    struct {
-		JobID string `json:"job_id"`
+		JobID         string `json:"job_id"`
+		Seed          int    `json:"seed"`                      // 实际使用的随机种子，可用于复现或微调生成结果
+		InputImageURL string `json:"input_image_url,omitempty"` // 预处理后提交给模型的输入图片，需携带令牌访问
 	} `json:"data"`
 }
 
-// 查询任务结果响应
-type QueryTaskResponse struct {
+// 任务列表中的单个任务
+type JobSummary struct {
+	JobID        string     `json:"job_id"`
+	Type         string     `json:"type"`
+	Status       string     `json:"status"`
+	Prompt       string     `json:"prompt"`
+	VideoURL     string     `json:"video_url,omitempty"`
+	ErrorMessage string     `json:"error_message,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// 任务列表响应
+type ListTasksResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message,omitempty"`
 	Data    struct {
-		JobID        string `json:"job_id"`
-		Status       string `json:"status"`
-		VideoURL     string `json:"video_url,omitempty"`
-		ErrorMessage string `json:"error_message,omitempty"`
+		Jobs       []JobSummary `json:"jobs"`
+		NextCursor string       `json:"next_cursor,omitempty"` // 为空表示没有更多数据
 	} `json:"data"`
 }
 
-// DashScope API请求体
-type DashScopeRequest struct {
-	Model      string `json:"model"`
-	Input      Input  `json:"input"`
-	Parameters Params `json:"parameters,omitempty"`
-}
-
-type Input struct {
-	Prompt         string `json:"prompt"`
-	NegativePrompt string `json:"negative_prompt,omitempty"`
-	ImgURL         string `json:"img_url,omitempty"`
-}
-
-type Params struct {
-	Size         string `json:"size,omitempty"`
-	Resolution   string `json:"resolution,omitempty"`
-	Duration     int    `json:"duration,omitempty"`
-	PromptExtend bool   `json:"prompt_extend,omitempty"`
-	Seed         int    `json:"seed,omitempty"`
-	Watermark    bool   `json:"watermark,omitempty"`
-}
-
-// DashScope API响应体
-type DashScopeResponse struct {
-	Output struct {
-		TaskStatus string `json:"task_status"`
-		TaskID     string `json:"task_id"`
-	} `json:"output"`
-	RequestID string `json:"request_id"`
-	Code      string `json:"code,omitempty"`
-	Message   string `json:"message,omitempty"`
-}
-
-// DashScope 查询任务结果响应
-type DashScopeQueryResponse struct {
-	RequestID string `json:"request_id"`
-	Output    struct {
-		TaskID        string `json:"task_id"`
-		TaskStatus    string `json:"task_status"`
-		SubmitTime    string `json:"submit_time"`
-		ScheduledTime string `json:"scheduled_time"`
-		EndTime       string `json:"end_time"`
-		VideoURL      string `json:"video_url,omitempty"`
-		OrigPrompt    string `json:"orig_prompt"`
-		ActualPrompt  string `json:"actual_prompt,omitempty"`
-	} `json:"output"`
-	Usage struct {
-		Duration   int    `json:"duration"`
-		VideoCount int    `json:"video_count"`
-		SR         int    `json:"SR,omitempty"`
-		VideoRatio string `json:"video_ratio,omitempty"`
-	} `json:"usage"`
-	Code    string `json:"code,omitempty"`
+// SSE心跳间隔
+const sseHeartbeatInterval = 15 * time.Second
+
+// 回调投递记录响应
+type WebhookDeliveriesResponse struct {
+	Code    int    `json:"code"`
 	Message string `json:"message,omitempty"`
+	Data    struct {
+		JobID       string                    `json:"job_id"`
+		CallbackURL string                    `json:"callback_url,omitempty"`
+		Deliveries  []*models.WebhookDelivery `json:"deliveries"`
+	} `json:"data"`
 }
 
-// 生成随机任务ID
-func generateJobID() (string, error) {
+// 幂等键请求头，客户端超时重试时携带相同的值以避免重复创建任务
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotentReplayHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength = 255
+)
+
+// 任务状态时间线响应
+type JobTimelineResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	Data    struct {
+		JobID       string                  `json:"job_id"`
+		Status      string                  `json:"status"`
+		Transitions []*models.JobTransition `json:"transitions"`
+	} `json:"data"`
+}
+
+// 取消任务时因并发修改而重新读取的最大次数
+const maxCancelAttempts = 3
+
+// 任务列表分页大小
+const (
+	defaultJobListLimit = 20
+	maxJobListLimit     = 100
+)
+
+// 生成带前缀的随机ID
+func generateID(prefix string) (string, error) {
 	bytes := make([]byte, 16)
 	if _, err := rand.Read(bytes); err != nil {
 		return "", err
 	}
-	return "job_" + hex.EncodeToString(bytes), nil
-}
-
-// 处理用户输入的提示词，通过文本模型优化提示词
-func processPromptWithTextModel(originalPrompt string, systemPrompt string) (string, error) {
-	apiKey := config.AppConfig.AI.Key
-	url := "https://dashscope.aliyuncs.com/compatible-mode/v1/chat/completions"
-
-	requestBody := map[string]interface{}{
-		"model": "qwen-flash",
-		"messages": []map[string]string{
-			{
-				"role":    "system",
-				"content": systemPrompt,
-			},
-			{
-				"role":    "user",
-				"content": originalPrompt,
-			},
+	return prefix + hex.EncodeToString(bytes), nil
+}
+
+// 生成随机任务ID
+func generateJobID() (string, error) {
+	return generateID("job_")
+}
+
+// 处理用户输入的提示词，通过文本模型优化提示词，返回处理后的提示词和消耗的token数
+func processPromptWithTextModel(ctx context.Context, client providers.ChatClient, model *config.TextModel, originalPrompt string, systemPrompt string) (string, providers.ChatUsage, error) {
+	response, err := client.Complete(ctx, providers.ChatRequest{
+		Model: model.Name,
+		Messages: []providers.ChatMessage{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: originalPrompt},
 		},
-		"enable_search": true,
-		"forced_search": true,
+		// 支持联网搜索的模型先搜索再回答，提高角色描述的准确度
+		Search: model.Search,
+	})
+	if err != nil {
+		return originalPrompt, providers.ChatUsage{}, err
+	}
+	if response.Content == "" {
+		return originalPrompt, response.Usage, fmt.Errorf("no content in response")
+	}
+	return response.Content, response.Usage, nil
+}
+
+// jobNotFoundResponse 任务不存在时的响应
+func jobNotFoundResponse(jobID string) services.QueryTaskResponse {
+	response := services.QueryTaskResponse{
+		Code:    404,
+		Message: "任务不存在",
+	}
+	response.Data.JobID = jobID
+	response.Data.Status = models.TaskUnknown
+	response.Data.Stage = models.TaskUnknown
+	return response
+}
+
+// loadOwnedJob 读取路径参数job_id指定的任务，只能读取当前用户自己创建的任务，任务不存在或不属于当前用户时统一按不存在处理
+// 返回true表示已写入错误响应，调用方直接返回error即可
+func (h *VideoHandler) loadOwnedJob(c *fiber.Ctx) (*models.Job, bool, error) {
+	jobID := c.Params("job_id")
+	if jobID == "" {
+		return nil, true, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Job ID is required",
+		})
 	}
 
-	jsonData, err := json.Marshal(requestBody)
+	userID, ok := c.Locals("userID").(int64)
+	if !ok {
+		return nil, true, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID in token",
+		})
+	}
+
+	job, err := h.jobRepo.FindByJobIDForUser(jobID, userID)
 	if err != nil {
-		return originalPrompt, fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, true, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load task data",
+		})
 	}
+	if job == nil {
+		return nil, true, c.Status(fiber.StatusNotFound).JSON(jobNotFoundResponse(jobID))
+	}
+	return job, false, nil
+}
+
+// VideoHandler 视频任务处理器
+type VideoHandler struct {
+	jobRepo      repositories.JobRepository
+	deliveryRepo repositories.WebhookDeliveryRepository
+	batchRepo    repositories.JobBatchRepository
+	canceler     services.JobCanceler
+	events       services.JobEventBroker
+	scheduler    services.JobScheduler
+	provider     providers.VideoProvider
+	catalog      services.ModelCatalog
+	chat         providers.ChatClient
+	usageRepo    repositories.UsageRepository
+
+	// idempotencyMu 串行化带幂等键的任务创建，避免并发的重复请求同时通过查重
+	idempotencyMu sync.Mutex
+}
 
-	cmd := exec.Command("curl", "-X", "POST", url,
-		"-H", "Authorization: Bearer "+apiKey,
-		"-H", "Content-Type: application/json",
-		"-d", string(jsonData),
-		"-s") // 添加 -s 来禁止进度条
+// NewVideoHandler 创建视频任务处理器实例
+func NewVideoHandler(jobRepo repositories.JobRepository, deliveryRepo repositories.WebhookDeliveryRepository, batchRepo repositories.JobBatchRepository, canceler services.JobCanceler, events services.JobEventBroker, scheduler services.JobScheduler, provider providers.VideoProvider, catalog services.ModelCatalog, chat providers.ChatClient, usageRepo repositories.UsageRepository) *VideoHandler {
+	return &VideoHandler{
+		jobRepo:      jobRepo,
+		deliveryRepo: deliveryRepo,
+		batchRepo:    batchRepo,
+		canceler:     canceler,
+		events:       events,
+		scheduler:    scheduler,
+		provider:     provider,
+		catalog:      catalog,
+		chat:         chat,
+		usageRepo:    usageRepo,
+	}
+}
 
-	output, err := cmd.CombinedOutput()
+// requestHash 计算创建请求参数的摘要
+func requestHash(req interface{}) (string, error) {
+	body, err := json.Marshal(req)
 	if err != nil {
-		return originalPrompt, fmt.Errorf("curl command failed: %w, output: %s", err, string(output))
+		return "", err
 	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
 
-	var response struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
+// replayIdempotentRequest 查找窗口期内使用同一幂等键创建的任务
+// 找到且参数相同时返回原任务ID，参数不同时拒绝请求；返回true表示已写入响应，调用方不应再创建任务
+func (h *VideoHandler) replayIdempotentRequest(c *fiber.Ctx, userID int64, key, hash string) (bool, error) {
+	since := time.Now().Add(-config.AppConfig.Idempotency.Window)
+	existing, err := h.jobRepo.FindByIdempotencyKey(userID, key, since)
+	if err != nil {
+		return true, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check Idempotency-Key",
+		})
+	}
+	if existing == nil {
+		return false, nil
 	}
-	fmt.Println("DashScope API Response:", string(output))
-	if err := json.Unmarshal(output, &response); err != nil {
-		return originalPrompt, fmt.Errorf("failed to unmarshal response: %w, response: %s", err, string(output))
+	if existing.RequestHash != hash {
+		return true, c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Idempotency-Key has already been used with a different request payload",
+		})
 	}
 
-	if len(response.Choices) > 0 {
-		return response.Choices[0].Message.Content, nil
+	c.Set(idempotentReplayHeader, "true")
+	response := CreateTaskResponse{
+		Code:    200,
+		Message: "任务已存在",
 	}
-	return originalPrompt, fmt.Errorf("no content in response")
+	response.Data.JobID = existing.JobID
+	response.Data.Seed = existing.Seed
+	response.Data.InputImageURL = services.InputImageURL(existing)
+	return true, c.JSON(response)
 }
 
-// 创建视频生成任务
-func CreateVideoTask(c *fiber.Ctx) error {
-	// 从 form-data 中解析字段
+// parseVideoCreateRequest 从 form-data 中解析创建视频任务的字段
+func parseVideoCreateRequest(c *fiber.Ctx) (VideoCreateRequest, error) {
+	params, err := parseGenerationParams(c)
+	if err != nil {
+		return VideoCreateRequest{}, err
+	}
+
+	image, err := readInputImage(c)
+	if err != nil {
+		return VideoCreateRequest{}, err
+	}
+
 	req := VideoCreateRequest{
-		Type:           c.FormValue("type"),
-		Prompt:         c.FormValue("prompt"),
-		NegativePrompt: c.FormValue("negative_prompt"),
-		Size:           c.FormValue("size"),
-		Resolution:     c.FormValue("resolution"),
-		ImgBase64:      c.FormValue("img_base64"),
+		Type:             c.FormValue("type"),
+		Prompt:           c.FormValue("prompt"),
+		NegativePrompt:   c.FormValue("negative_prompt"),
+		Size:             c.FormValue("size"),
+		Resolution:       c.FormValue("resolution"),
+		Image:            image,
+		AspectRatio:      c.FormValue("aspect_ratio"),
+		Fit:              c.FormValue("fit"),
+		CallbackURL:      c.FormValue("callback_url"),
+		Model:            c.FormValue("model"),
+		GenerationParams: params,
 	}
 
-	// 验证必填字段
-	if req.Type != "text_to_video" && req.Type != "image_to_video" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid type. Must be 'text_to_video' or 'image_to_video'",
+	// 图片在解析时完成预处理，批量创建的任务共用一次处理结果；缺少分辨率时由校验给出错误
+	if req.Type == models.JobTypeImageToVideo && req.Image != nil && req.Resolution != "" {
+		req.Image, err = services.PreprocessInputImage(req.Image, services.ImageOptions{
+			Resolution:  req.Resolution,
+			AspectRatio: req.AspectRatio,
+			Fit:         req.Fit,
 		})
+		if err != nil {
+			return VideoCreateRequest{}, err
+		}
+	}
+	return req, nil
+}
+
+// validateVideoCreateRequest 校验创建视频任务的请求参数并确定使用的模型，单个创建和批量创建共用
+func validateVideoCreateRequest(req *VideoCreateRequest, catalog services.ModelCatalog) error {
+	if req.Type != models.JobTypeTextToVideo && req.Type != models.JobTypeImageToVideo {
+		return fmt.Errorf("Invalid type. Must be 'text_to_video' or 'image_to_video'")
 	}
 
 	if req.Prompt == "" {
+		return fmt.Errorf("Prompt is required")
+	}
+
+	// 根据类型验证其他字段
+	if req.Type == models.JobTypeTextToVideo {
+		if req.Size == "" {
+			return fmt.Errorf("Size is required for text_to_video")
+		}
+		// 文生视频不使用图片，与之前忽略img_base64字段的行为保持一致
+		req.Image = nil
+	}
+
+	if req.Type == models.JobTypeImageToVideo {
+		if req.Resolution == "" {
+			return fmt.Errorf("Resolution is required for image_to_video")
+		}
+		if req.Image == nil {
+			return fmt.Errorf("image is required for image_to_video")
+		}
+	}
+
+	// 模型需支持请求的生成方式，分辨率需在模型允许的范围内
+	capability := services.CapabilityTextToVideo
+	if req.Type == models.JobTypeImageToVideo {
+		capability = services.CapabilityImageToVideo
+	}
+	model, err := catalog.ResolveVideoModel(req.Model, capability)
+	if err != nil {
+		return err
+	}
+	req.Model = model.Name
+	if err := validateModelSize(model, req.Size, req.Resolution); err != nil {
+		return err
+	}
+	if err := validateGenerationParams(model, &req.GenerationParams); err != nil {
+		return err
+	}
+
+	if req.CallbackURL != "" {
+		if err := services.ValidateCallbackURL(req.CallbackURL); err != nil {
+			return fmt.Errorf("Invalid callback_url: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateModelSize 校验分辨率是否在模型允许的范围内，模型未限制时不校验
+func validateModelSize(model *config.VideoModel, size, resolution string) error {
+	if size != "" && len(model.Sizes) > 0 && !slices.Contains(model.Sizes, size) {
+		return fmt.Errorf("Size %s is not supported by model %s", size, model.Name)
+	}
+	if resolution != "" && len(model.Resolutions) > 0 && !slices.Contains(model.Resolutions, resolution) {
+		return fmt.Errorf("Resolution %s is not supported by model %s", resolution, model.Name)
+	}
+	return nil
+}
+
+// newJobFromRequest 根据已校验的请求参数构造待提交的任务
+func newJobFromRequest(jobID string, userID int64, req *VideoCreateRequest) *models.Job {
+	job := &models.Job{
+		JobID:          jobID,
+		UserID:         userID,
+		Type:           req.Type,
+		Status:         models.TaskPending,
+		Model:          req.Model,
+		Prompt:         req.Prompt,
+		NegativePrompt: req.NegativePrompt,
+		Size:           req.Size,
+		Resolution:     req.Resolution,
+		CallbackURL:    req.CallbackURL,
+	}
+	req.GenerationParams.applyTo(job)
+	return job
+}
+
+// 创建视频生成任务
+func (h *VideoHandler) CreateVideoTask(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(int64)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID in token",
+		})
+	}
+
+	// 从 form-data 中解析字段
+	req, err := parseVideoCreateRequest(c)
+	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Prompt is required",
+			"error": err.Error(),
 		})
 	}
 
-	// 根据类型验证其他字段
-	if req.Type == "text_to_video" && req.Size == "" {
+	// 验证必填字段
+	if err := validateVideoCreateRequest(&req, h.catalog); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Size is required for text_to_video",
+			"error": err.Error(),
 		})
 	}
 
-	if req.Type == "image_to_video" {
-		if req.Resolution == "" {
+	// 带幂等键的重复请求直接返回原任务，查重和创建任务需在同一把锁内完成
+	var hash string
+	idempotencyKey := c.Get(idempotencyKeyHeader)
+	if idempotencyKey != "" {
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Resolution is required for image_to_video",
+				"error": fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength),
 			})
 		}
-		if req.ImgBase64 == "" {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "img_base64 is required for image_to_video",
+
+		if hash, err = requestHash(req); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to hash request",
 			})
 		}
+
+		h.idempotencyMu.Lock()
+		defer h.idempotencyMu.Unlock()
+		if handled, err := h.replayIdempotentRequest(c, userID, idempotencyKey, hash); handled {
+			return err
+		}
 	}
 
 	// 生成任务ID
@@ -230,304 +447,407 @@ func CreateVideoTask(c *fiber.Ctx) error {
 		})
 	}
 
-	// 调用DashScope API创建任务
-	var dashScopeReq DashScopeRequest
-
-	// 根据类型设置模型和参数
-	if req.Type == "text_to_video" {
-		// 文生视频使用 wanx2.1-t2v-turbo 模型
-		dashScopeReq = DashScopeRequest{
-			Model: "wanx2.1-t2v-turbo",
-			Input: Input{
-				Prompt:         req.Prompt,
-				NegativePrompt: req.NegativePrompt,
-			},
-			Parameters: Params{
-				Size: req.Size,
-			},
-		}
-	} else if req.Type == "image_to_video" {
-		// 图生视频使用 wan2.2-i2v-flash 模型
-		dashScopeReq = DashScopeRequest{
-			Model: "wan2.2-i2v-flash",
-			Input: Input{
-				Prompt:         req.Prompt,
-				NegativePrompt: req.NegativePrompt,
-				ImgURL:         req.ImgBase64,
-			},
-			Parameters: Params{
-				Resolution: req.Resolution,
-			},
+	// 保存任务信息到数据库，输入图片保存为文件，任务只记录路径
+	job := newJobFromRequest(jobID, userID, &req)
+	job.IdempotencyKey = idempotencyKey
+	job.RequestHash = hash
+	if req.Image != nil {
+		if job.InputImagePath, err = services.SaveInputImage(req.Image); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
 		}
 	}
+	if err := h.jobRepo.Create(job); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save job: " + err.Error(),
+		})
+	}
 
-	// 保存任务信息到文件(模拟任务队列/数据库)
-	taskFile := fmt.Sprintf("tasks/%s.json", jobID)
-	os.MkdirAll("tasks", 0755)
+	// 加入提交队列，由调度器在有空闲名额时提交到视频生成服务
+	h.scheduler.Enqueue(job)
 
-	taskData := map[string]interface{}{
-		"job_id":            jobID,
-		"status":            TaskPending,
-		"request":           req,
-		"created_at":        time.Now().Format(time.RFC3339),
-		"dashscope_task_id": "",
+	// 返回成功响应
+	response := CreateTaskResponse{
+		Code:    200,
+		Message: "任务创建成功",
 	}
+	response.Data.JobID = jobID
+	response.Data.Seed = job.Seed
+	response.Data.InputImageURL = services.InputImageURL(job)
 
-	taskJSON, _ := json.Marshal(taskData)
-	os.WriteFile(taskFile, taskJSON, 0644)
+	return c.JSON(response)
+}
 
-	// 异步调用DashScope API
-	go func() {
-		// 更新任务状态为运行中
-		taskData["status"] = TaskRunning
-		taskJSON, _ := json.Marshal(taskData)
-		os.WriteFile(taskFile, taskJSON, 0644)
+// 列出可用的视频和文本模型，供前端构建模型选择列表
+func (h *VideoHandler) ListModels(c *fiber.Ctx) error {
+	response := ListModelsResponse{Code: 200}
+	response.Data.Video = h.catalog.VideoModels()
+	response.Data.Text = h.catalog.TextModels()
+	return c.JSON(response)
+}
 
-		// 调用DashScope API
-		apiKey := config.AppConfig.AI.Key
+// 查询任务结果，任务状态由后台轮询器推进，这里只读取数据库记录
+func (h *VideoHandler) GetVideoTaskResult(c *fiber.Ctx) error {
+	job, handled, err := h.loadOwnedJob(c)
+	if handled {
+		return err
+	}
 
-		url := "https://dashscope.aliyuncs.com/api/v1/services/aigc/video-generation/video-synthesis"
+	return c.JSON(services.NewCompatQueryTaskResponse(job))
+}
 
-		jsonData, _ := json.Marshal(dashScopeReq)
+// 通过SSE推送单个任务的状态变化，连接建立后先推送当前状态，任务结束后关闭连接
+func (h *VideoHandler) StreamVideoTaskEvents(c *fiber.Ctx) error {
+	job, handled, err := h.loadOwnedJob(c)
+	if handled {
+		return err
+	}
 
-		// 创建HTTP请求
-		request, _ := http.NewRequest("POST", url, strings.NewReader(string(jsonData)))
-		request.Header.Set("Authorization", "Bearer "+apiKey)
-		request.Header.Set("Content-Type", "application/json")
-		request.Header.Set("X-DashScope-Async", "enable")
+	// 订阅后重新读取当前状态，避免错过首次读取和订阅之间发生的状态变化
+	events, unsubscribe := h.events.Subscribe(job.UserID)
+	if latest, err := h.jobRepo.FindByJobIDForUser(job.JobID, job.UserID); err == nil && latest != nil {
+		job = latest
+	}
+	jobID := job.JobID
 
-		client := &http.Client{}
-		response, err := client.Do(request)
-		if err != nil {
-			// 更新任务状态为失败
-			taskData["status"] = TaskFailed
-			taskData["error"] = err.Error()
-			taskJSON, _ := json.Marshal(taskData)
-			os.WriteFile(taskFile, taskJSON, 0644)
+	setEventStreamHeaders(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		if writeJobEvent(w, job) != nil || job.IsTerminal() {
 			return
 		}
-		defer response.Body.Close()
 
-		body, _ := io.ReadAll(response.Body)
+		heartbeat := time.NewTicker(sseHeartbeatInterval)
+		defer heartbeat.Stop()
 
-		var dashScopeResp DashScopeResponse
-		if err := json.Unmarshal(body, &dashScopeResp); err != nil {
-			// 更新任务状态为失败
-			taskData["status"] = TaskFailed
-			taskData["error"] = "Failed to parse DashScope response: " + err.Error() + ", response: " + string(body)
-			taskJSON, _ := json.Marshal(taskData)
-			os.WriteFile(taskFile, taskJSON, 0644)
-			return
+		for {
+			select {
+			case event := <-events:
+				if event.JobID != jobID {
+					continue
+				}
+				if writeJobEvent(w, &event) != nil || event.IsTerminal() {
+					return
+				}
+			case <-heartbeat.C:
+				// 定期发送注释行，客户端断开时写入失败即可结束
+				if writeSSEComment(w, "ping") != nil {
+					return
+				}
+			}
 		}
+	})
+	return nil
+}
 
-		if dashScopeResp.Code != "" {
-			// 更新任务状态为失败
-			taskData["status"] = TaskFailed
-			taskData["error"] = dashScopeResp.Message
-			taskJSON, _ := json.Marshal(taskData)
-			os.WriteFile(taskFile, taskJSON, 0644)
+// 通过SSE推送当前用户所有任务的状态变化，连接一直保持到客户端断开
+func (h *VideoHandler) StreamUserTaskEvents(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(int64)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID in token",
+		})
+	}
+
+	events, unsubscribe := h.events.Subscribe(userID)
+
+	setEventStreamHeaders(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		// 先发送注释行，让客户端尽快确认连接已建立
+		if writeSSEComment(w, "connected") != nil {
 			return
 		}
 
-		// 保存DashScope任务ID
-		taskData["dashscope_task_id"] = dashScopeResp.Output.TaskID
-		taskData["status"] = TaskRunning
-		taskJSON, _ = json.Marshal(taskData)
-		os.WriteFile(taskFile, taskJSON, 0644)
-	}()
+		heartbeat := time.NewTicker(sseHeartbeatInterval)
+		defer heartbeat.Stop()
 
-	// 返回成功响应
-	response := CreateTaskResponse{
-		Code:    200,
-		Message: "任务创建成功",
+		for {
+			select {
+			case event := <-events:
+				if writeJobEvent(w, &event) != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if writeSSEComment(w, "ping") != nil {
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// setEventStreamHeaders 设置SSE响应头
+func setEventStreamHeaders(c *fiber.Ctx) {
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no") // 禁止反向代理缓冲
+}
+
+// writeJobEvent 以SSE格式写入一条任务状态事件，数据与查询接口的响应相同
+func writeJobEvent(w *bufio.Writer, job *models.Job) error {
+	data, err := json.Marshal(services.NewQueryTaskResponse(job))
+	if err != nil {
+		return err
 	}
-	response.Data.JobID = jobID
+	if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
 
-	return c.JSON(response)
+// writeSSEComment 写入一条SSE注释行
+func writeSSEComment(w *bufio.Writer, comment string) error {
+	if _, err := fmt.Fprintf(w, ": %s\n\n", comment); err != nil {
+		return err
+	}
+	return w.Flush()
 }
 
-// 查询任务结果
-func GetVideoTaskResult(c *fiber.Ctx) error {
-	jobID := c.Params("job_id")
-	if jobID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Job ID is required",
+// 取消进行中的任务，中止本地的提交和转换工作，并尽量请求视频生成服务取消
+func (h *VideoHandler) CancelVideoTask(c *fiber.Ctx) error {
+	// 任务在读取之后被后台流程修改时版本号会变化，重新读取后再次尝试
+	var job *models.Job
+	for attempt := 1; ; attempt++ {
+		var handled bool
+		var err error
+		job, handled, err = h.loadOwnedJob(c)
+		if handled {
+			return err
+		}
+
+		if err := job.TransitionTo(models.TaskCanceled, models.JobStepCancel, "用户取消"); err != nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Job has already finished",
+			})
+		}
+		job.FinishedAt = time.Now()
+		updated, err := h.jobRepo.UpdateIfActive(job)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to cancel job",
+			})
+		}
+		if updated {
+			break
+		}
+		if attempt == maxCancelAttempts {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Job is being updated, please try again",
+			})
+		}
+	}
+
+	// 中止本地进行中的工作，后台流程也无法再覆盖CANCELED状态
+	h.canceler.Cancel(job.JobID)
+	if job.UpstreamTaskID != "" {
+		services.CancelUpstreamTask(h.provider, job.UpstreamTaskID)
+	}
+
+	return c.JSON(services.NewQueryTaskResponse(job))
+}
+
+// 重试失败的任务，使用任务保存的原始参数从失败的步骤继续
+func (h *VideoHandler) RetryVideoTask(c *fiber.Ctx) error {
+	job, handled, err := h.loadOwnedJob(c)
+	if handled {
+		return err
+	}
+	if job.Status != models.TaskFailed {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only failed jobs can be retried",
 		})
 	}
 
-	// 读取任务文件
-	taskFile := fmt.Sprintf("tasks/%s.json", jobID)
-	taskDataBytes, err := os.ReadFile(taskFile)
+	resubmit := false
+	status := models.TaskPending
+	switch {
+	case (job.FailedStep == models.JobStepDownload || job.FailedStep == models.JobStepConvert) &&
+		job.VideoURL != "" && time.Now().Before(job.VideoExpiresAt):
+		// 原始视频地址仍然有效，只需重新下载和转换，由后台轮询器接手
+		status = models.TaskConverting
+	case job.FailedStep == models.JobStepQuery && job.UpstreamTaskID != "":
+		// 查询状态失败时上游任务可能仍在进行，重新交给后台轮询器查询
+		status = models.TaskRunning
+	default:
+		// 其余情况重新提交到视频生成服务
+		job.UpstreamTaskID = ""
+		job.VideoURL = ""
+		job.VideoExpiresAt = time.Time{}
+		job.OrigPrompt = ""
+		job.ActualPrompt = ""
+		resubmit = true
+	}
+	if err := job.TransitionTo(status, models.JobStepRetry, "用户重试，从"+job.FailedStep+"步骤继续"); err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only failed jobs can be retried",
+		})
+	}
+	job.RetryCount++
+	job.Error = ""
+	job.FailedStep = ""
+	job.PollFailures = 0
+	job.FinishedAt = time.Time{}
+
+	// 只有仍处于失败状态的任务才能重试，避免并发重试重复提交
+	updated, err := h.jobRepo.UpdateIfStatus(job, models.TaskFailed)
 	if err != nil {
-		// 任务不存在
-		response := QueryTaskResponse{
-			Code:    500,
-			Message: "任务不存在",
-		}
-		response.Data.JobID = jobID
-		response.Data.Status = TaskUnknown
-		return c.JSON(response)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retry job",
+		})
+	}
+	if !updated {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only failed jobs can be retried",
+		})
+	}
+
+	if resubmit {
+		h.scheduler.Enqueue(job)
 	}
 
-	var taskData map[string]interface{}
-	if err := json.Unmarshal(taskDataBytes, &taskData); err != nil {
+	return c.JSON(services.NewQueryTaskResponse(job))
+}
+
+// 查询任务的状态转换时间线，便于排查任务卡住或失败的原因
+func (h *VideoHandler) GetVideoTaskTimeline(c *fiber.Ctx) error {
+	job, handled, err := h.loadOwnedJob(c)
+	if handled {
+		return err
+	}
+
+	transitions, err := h.jobRepo.FindTransitions(job.JobID)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to parse task data",
+			"error": "Failed to load task timeline",
 		})
 	}
 
-	status := taskData["status"].(string)
-	dashscopeTaskID, _ := taskData["dashscope_task_id"].(string)
+	response := JobTimelineResponse{Code: 200}
+	response.Data.JobID = job.JobID
+	response.Data.Status = job.Status
+	response.Data.Transitions = transitions
+	return c.JSON(response)
+}
 
-	// 如果是运行中或等待中的任务，并且已经获取到了dashscope_task_id，就查询DashScope API获取最新状态
-	if (status == TaskRunning || status == TaskPending) && dashscopeTaskID != "" {
-		// 查询DashScope任务状态
-		apiKey := config.AppConfig.AI.Key
+// 查询任务的回调投递记录，便于排查回调问题
+func (h *VideoHandler) ListWebhookDeliveries(c *fiber.Ctx) error {
+	job, handled, err := h.loadOwnedJob(c)
+	if handled {
+		return err
+	}
 
-		url := fmt.Sprintf("https://dashscope.aliyuncs.com/api/v1/tasks/%s", dashscopeTaskID)
+	deliveries, err := h.deliveryRepo.FindByJobID(job.JobID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load webhook deliveries",
+		})
+	}
 
-		request, _ := http.NewRequest("GET", url, nil)
-		request.Header.Set("Authorization", "Bearer "+apiKey)
+	response := WebhookDeliveriesResponse{
+		Code: 200,
+	}
+	response.Data.JobID = job.JobID
+	response.Data.CallbackURL = job.CallbackURL
+	response.Data.Deliveries = deliveries
+	return c.JSON(response)
+}
 
-		client := &http.Client{}
-		response, err := client.Do(request)
-		if err != nil {
-			// 查询失败，将任务标记为失败并记录错误
-			status = TaskFailed
-			taskData["status"] = status
-			taskData["error"] = "Failed to query DashScope task status: " + err.Error()
-			taskJSON, _ := json.Marshal(taskData)
-			os.WriteFile(taskFile, taskJSON, 0644)
-		} else {
-			defer response.Body.Close()
-			body, _ := io.ReadAll(response.Body)
-
-			var dashScopeQueryResp DashScopeQueryResponse
-			if err := json.Unmarshal(body, &dashScopeQueryResp); err == nil {
-				// 更新本地任务状态
-				switch dashScopeQueryResp.Output.TaskStatus {
-				case "PENDING":
-					status = TaskPending
-				case "RUNNING":
-					status = TaskRunning
-				case "SUCCEEDED":
-					status = TaskSucceeded
-					taskData["video_url"] = dashScopeQueryResp.Output.VideoURL
-				case "FAILED":
-					status = TaskFailed
-					// 优先使用DashScope返回的详细错误信息
-					if dashScopeQueryResp.Message != "" {
-						taskData["error"] = dashScopeQueryResp.Message
-					} else {
-						taskData["error"] = "Task failed on DashScope without a specific message."
-					}
-				case "UNKNOWN":
-					status = TaskUnknown
-				default:
-					status = TaskUnknown
-				}
+// newJobSummary 构造任务列表中的单个任务，成功时附带GIF地址，失败时附带错误信息
+func newJobSummary(job *models.Job) JobSummary {
+	summary := JobSummary{
+		JobID:     job.JobID,
+		Type:      job.Type,
+		Status:    job.Status,
+		Prompt:    job.Prompt,
+		CreatedAt: job.CreatedAt,
+	}
+	if job.Status == models.TaskSucceeded {
+		summary.VideoURL = job.OutputURL
+	} else if job.Status == models.TaskFailed {
+		summary.ErrorMessage = job.Error
+	}
+	if !job.FinishedAt.IsZero() {
+		finishedAt := job.FinishedAt
+		summary.FinishedAt = &finishedAt
+	}
+	return summary
+}
 
-				// 更新任务文件
-				taskData["status"] = status
-				taskJSON, _ := json.Marshal(taskData)
-				os.WriteFile(taskFile, taskJSON, 0644)
-			} else {
-				// JSON解析失败，也标记为失败
-				status = TaskFailed
-				taskData["status"] = status
-				taskData["error"] = "Failed to parse DashScope query response: " + err.Error() + ", response body: " + string(body)
-				taskJSON, _ := json.Marshal(taskData)
-				os.WriteFile(taskFile, taskJSON, 0644)
-			}
-		}
+// 查询当前用户的历史任务，按创建时间倒序，支持游标分页以及按状态和类型过滤
+func (h *VideoHandler) ListVideoTasks(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(int64)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID in token",
+		})
 	}
 
-	// 如果任务成功，将视频转换为GIF
-	if status == TaskSucceeded {
-		if videoURL, ok := taskData["video_url"].(string); ok && !strings.HasSuffix(videoURL, ".gif") {
-			fmt.Println("开始下载视频:", videoURL)
-			// 1. 下载视频文件
-			videoPath := fmt.Sprintf("tasks/%s.mp4", jobID)
-			resp, err := http.Get(videoURL)
-			if err != nil {
-				status = TaskFailed
-				taskData["status"] = status
-				taskData["error"] = "Failed to download video: " + err.Error()
-				fmt.Println("下载视频失败:", err)
-			} else {
-				defer resp.Body.Close()
-				out, err := os.Create(videoPath)
-				if err != nil {
-					status = TaskFailed
-					taskData["status"] = status
-					taskData["error"] = "Failed to create video file: " + err.Error()
-					fmt.Println("创建视频文件失败:", err)
-				} else {
-					defer out.Close()
-					_, err = io.Copy(out, resp.Body)
-					if err != nil {
-						status = TaskFailed
-						taskData["status"] = status
-						taskData["error"] = "Failed to save video file: " + err.Error()
-						fmt.Println("保存视频文件失败:", err)
-					} else {
-						fmt.Println("视频下载成功:", videoPath)
-						// 2. 本地转换为标准GIF (适合微信发送的尺寸)
-						gifPath := fmt.Sprintf("tasks/%s.gif", jobID)
-						// 使用两步法优化GIF，保持原始宽高比:
-						// 第一步: 生成调色板
-						palettePath := fmt.Sprintf("tasks/%s_palette.png", jobID)
-						paletteCmd := exec.Command("ffmpeg", "-i", videoPath, "-vf", "scale=240:240:force_original_aspect_ratio=decrease,pad=240:240:(ow-iw)/2:(oh-ih)/2:color=black@0,palettegen", palettePath)
-						paletteOutput, err := paletteCmd.CombinedOutput()
-						if err != nil {
-							status = TaskFailed
-							taskData["status"] = status
-							taskData["error"] = "Failed to generate palette: " + err.Error()
-							fmt.Println("调色板生成失败:", err, string(paletteOutput))
-						} else {
-							// 第二步: 使用调色板生成优化的GIF，保持原始宽高比
-							cmd := exec.Command("ffmpeg", "-i", videoPath, "-i", palettePath, "-lavfi", "scale=240:240:force_original_aspect_ratio=decrease,pad=240:240:(ow-iw)/2:(oh-ih)/2:color=black@0,fps=8 [x]; [x][1:v] paletteuse", "-f", "gif", gifPath)
-							output, err := cmd.CombinedOutput()
-							if err != nil {
-								status = TaskFailed
-								taskData["status"] = status
-								taskData["error"] = "Failed to convert video to GIF: " + err.Error()
-								fmt.Println("ffmpeg转换失败:", err, string(output))
-							} else {
-								finalGifURL := fmt.Sprintf("https://"+config.AppConfig.Server.Host+":"+config.AppConfig.Server.Port+"/tasks/%s.gif", jobID)
-								taskData["video_url"] = finalGifURL
-								fmt.Println("GIF生成成功:", finalGifURL)
-							}
-							// 清理调色板文件
-							os.Remove(palettePath)
-						}
-						// 3. 清理临时视频文件
-						os.Remove(videoPath)
-					}
-				}
-			}
-			taskJSON, _ := json.Marshal(taskData)
-			os.WriteFile(taskFile, taskJSON, 0644)
+	filter := repositories.JobListFilter{
+		Status: c.Query("status"),
+		Type:   c.Query("type"),
+		Limit:  c.QueryInt("limit", defaultJobListLimit),
+	}
+
+	switch filter.Status {
+	case "", models.TaskPending, models.TaskRunning, models.TaskConverting, models.TaskSucceeded, models.TaskFailed, models.TaskCanceled:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid status",
+		})
+	}
+
+	switch filter.Type {
+	case "", models.JobTypeTextToVideo, models.JobTypeImageToVideo, models.JobTypePromptToVideo:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid type. Must be 'text_to_video', 'image_to_video' or 'prompt_to_video'",
+		})
+	}
+
+	if filter.Limit <= 0 || filter.Limit > maxJobListLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("limit must be between 1 and %d", maxJobListLimit),
+		})
+	}
+
+	// 游标为上一页最后一个任务的内部ID
+	if cursor := c.Query("cursor"); cursor != "" {
+		beforeID, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || beforeID <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
 		}
+		filter.BeforeID = beforeID
 	}
 
-	// 构造响应
-	response := QueryTaskResponse{
+	// 多取一条用于判断是否还有下一页
+	requested := filter.Limit
+	filter.Limit++
+	jobs, err := h.jobRepo.ListByUser(userID, filter)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load jobs",
+		})
+	}
+
+	response := ListTasksResponse{
 		Code: 200,
 	}
-	response.Data.JobID = jobID
-	response.Data.Status = status
+	response.Data.Jobs = make([]JobSummary, 0, len(jobs))
+	if len(jobs) > requested {
+		jobs = jobs[:requested]
+		response.Data.NextCursor = strconv.FormatInt(jobs[len(jobs)-1].ID, 10)
+	}
 
-	if status == TaskSucceeded {
-		if videoURL, ok := taskData["video_url"].(string); ok {
-			response.Data.VideoURL = videoURL
-		}
-	} else if status == TaskFailed {
-		if errorMsg, ok := taskData["error"].(string); ok {
-			response.Data.ErrorMessage = errorMsg
-		} else {
-			response.Data.ErrorMessage = "视频生成失败"
-		}
+	for _, job := range jobs {
+		response.Data.Jobs = append(response.Data.Jobs, newJobSummary(job))
 	}
 
 	return c.JSON(response)
@@ -535,35 +855,88 @@ func GetVideoTaskResult(c *fiber.Ctx) error {
 
 // VideoCreateRequestWithPromptProcessing defines the request for the new video creation endpoint
 type VideoCreateRequestWithPromptProcessing struct {
-	Role   string `json:"role"`
-	Source string `json:"source"` // Optional
-	Action string `json:"action"`
-	Size   string `json:"size"`
+	Role        string `json:"role"`
+	Source      string `json:"source"` // Optional
+	Action      string `json:"action"`
+	Size        string `json:"size"`
+	CallbackURL string `json:"callback_url"` // Optional
+	Model       string `json:"model"`        // Optional, video model
+	TextModel   string `json:"text_model"`   // Optional, text model used to describe the role
+	GenerationParams
 }
 
 // CreateVideoTaskWithPromptProcessing handles the new video creation process
-func CreateVideoTaskWithPromptProcessing(c *fiber.Ctx) error {
+func (h *VideoHandler) CreateVideoTaskWithPromptProcessing(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(int64)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid user ID in token"})
+	}
+
 	// 1. Parse request from form-data
 	req := VideoCreateRequestWithPromptProcessing{
-		Role:   c.FormValue("role"),
-		Source: c.FormValue("source"),
-		Action: c.FormValue("action"),
-		Size:   c.FormValue("size"),
+		Role:        c.FormValue("role"),
+		Source:      c.FormValue("source"),
+		Action:      c.FormValue("action"),
+		Size:        c.FormValue("size"),
+		CallbackURL: c.FormValue("callback_url"),
+		Model:       c.FormValue("model"),
+		TextModel:   c.FormValue("text_model"),
 	}
 
 	if req.Role == "" || req.Action == "" || req.Size == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "role, action, and size are required"})
 	}
 
+	params, err := parseGenerationParams(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	req.GenerationParams = params
+
+	videoModel, err := h.catalog.ResolveVideoModel(req.Model, services.CapabilityTextToVideo)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := validateModelSize(videoModel, req.Size, ""); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := validateGenerationParams(videoModel, &req.GenerationParams); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	textModel, err := h.catalog.ResolveTextModel(req.TextModel)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if req.CallbackURL != "" {
+		if err := services.ValidateCallbackURL(req.CallbackURL); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid callback_url: " + err.Error()})
+		}
+	}
+
 	// 2. First prompt processing
 	roleInfo := req.Role
 	if req.Source != "" {
 		roleInfo = fmt.Sprintf("%s (来自 %s)", req.Role, req.Source)
 	}
 
-	processedPrompt1, err := processPromptWithTextModel(roleInfo, "你是一个角色描绘大师，请你根据网络搜索使用语言详细的描述这个角色的外貌，体型，颜色，外观,请开始分析并严格按照格式输出，只输出最终的描述，不要包含任何markdown格式或标题。")
+	// Fiber的UserContext默认为context.Background()，不会随请求结束而取消，
+	// 文本模型调用(包括重试)限定在chat.timeout内，处理函数返回时一并取消
+	chatCtx, cancel := context.WithTimeout(c.UserContext(), config.AppConfig.Chat.Timeout)
+	defer cancel()
+	processedPrompt1, usage, err := processPromptWithTextModel(chatCtx, h.chat, textModel, roleInfo, "你是一个角色描绘大师，请你根据网络搜索使用语言详细的描述这个角色的外貌，体型，颜色，外观,请开始分析并严格按照格式输出，只输出最终的描述，不要包含任何markdown格式或标题。")
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed in first prompt processing step: " + err.Error()})
+		status := fiber.StatusInternalServerError
+		var retryAfter *providers.RetryAfterError
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = fiber.StatusGatewayTimeout
+		} else if errors.Is(err, providers.ErrCircuitOpen) {
+			status = fiber.StatusServiceUnavailable
+		} else if errors.As(err, &retryAfter) {
+			status = fiber.StatusServiceUnavailable
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(retryAfter.Wait.Seconds())))
+		}
+		return c.Status(status).JSON(fiber.Map{"error": "Failed in first prompt processing step: " + err.Error()})
 	}
 
 	// 4. Create video task
@@ -572,85 +945,46 @@ func CreateVideoTaskWithPromptProcessing(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate job ID"})
 	}
 
-	dashScopeReq := DashScopeRequest{
-		Model: "wanx2.1-t2v-turbo",
-		Input: Input{
-			Prompt: fmt.Sprintf("角色:%s。角色描述: %s。动作: %s。", roleInfo, processedPrompt1, req.Action),
-		},
-		Parameters: Params{
-			Size: req.Size,
-		},
+	finalPrompt := fmt.Sprintf("角色:%s。角色描述: %s。动作: %s。", roleInfo, processedPrompt1, req.Action)
+	job := &models.Job{
+		JobID:       jobID,
+		UserID:      userID,
+		Type:        models.JobTypePromptToVideo,
+		Status:      models.TaskPending,
+		Model:       videoModel.Name,
+		Prompt:      finalPrompt,
+		Size:        req.Size,
+		CallbackURL: req.CallbackURL,
 	}
-
-	taskFile := fmt.Sprintf("tasks/%s.json", jobID)
-	os.MkdirAll("tasks", 0755)
-
-	taskData := map[string]interface{}{
-		"job_id":            jobID,
-		"status":            TaskPending,
-		"request":           req,
-		"created_at":        time.Now().Format(time.RFC3339),
-		"dashscope_task_id": "",
-		"final_prompt":      fmt.Sprintf("角色:%s。角色描述: %s。动作: %s。", roleInfo, processedPrompt1, req.Action),
+	req.GenerationParams.applyTo(job)
+	job.RolePrompt = processedPrompt1
+	job.TextModel = textModel.Name
+	job.TextTokens = usage.TotalTokens
+	job.Cost = h.catalog.TextCost(textModel.Name, usage.TotalTokens)
+	if err := h.jobRepo.Create(job); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save job: " + err.Error()})
 	}
-	taskJSON, _ := json.Marshal(taskData)
-	os.WriteFile(taskFile, taskJSON, 0644)
-
-	go func() {
-		taskData["status"] = TaskRunning
-		taskJSON, _ := json.Marshal(taskData)
-		os.WriteFile(taskFile, taskJSON, 0644)
-
-		apiKey := config.AppConfig.AI.Key
-		url := "https://dashscope.aliyuncs.com/api/v1/services/aigc/video-generation/video-synthesis"
-		jsonData, _ := json.Marshal(dashScopeReq)
 
-		request, _ := http.NewRequest("POST", url, strings.NewReader(string(jsonData)))
-		request.Header.Set("Authorization", "Bearer "+apiKey)
-		request.Header.Set("Content-Type", "application/json")
-		request.Header.Set("X-DashScope-Async", "enable")
-
-		client := &http.Client{}
-		response, err := client.Do(request)
-		if err != nil {
-			taskData["status"] = TaskFailed
-			taskData["error"] = err.Error()
-			taskJSON, _ := json.Marshal(taskData)
-			os.WriteFile(taskFile, taskJSON, 0644)
-			return
-		}
-		defer response.Body.Close()
-
-		body, _ := io.ReadAll(response.Body)
-
-		var dashScopeResp DashScopeResponse
-		if err := json.Unmarshal(body, &dashScopeResp); err != nil {
-			taskData["status"] = TaskFailed
-			taskData["error"] = "Failed to parse DashScope response: " + err.Error() + ", response: " + string(body)
-			taskJSON, _ := json.Marshal(taskData)
-			os.WriteFile(taskFile, taskJSON, 0644)
-			return
-		}
-
-		if dashScopeResp.Code != "" {
-			taskData["status"] = TaskFailed
-			taskData["error"] = dashScopeResp.Message
-			taskJSON, _ := json.Marshal(taskData)
-			os.WriteFile(taskFile, taskJSON, 0644)
-			return
-		}
+	// 记录文本模型的用量，视频的用量在上游生成完成时由后台轮询器记录
+	if err := h.usageRepo.Create(&models.UsageRecord{
+		UserID:     userID,
+		JobID:      jobID,
+		Kind:       models.UsageKindText,
+		Model:      textModel.Name,
+		TextTokens: usage.TotalTokens,
+		Cost:       job.Cost,
+	}); err != nil {
+		log.Printf("记录任务 %s 的文本模型用量失败: %v", jobID, err)
+	}
 
-		taskData["dashscope_task_id"] = dashScopeResp.Output.TaskID
-		taskData["status"] = TaskRunning
-		taskJSON, _ = json.Marshal(taskData)
-		os.WriteFile(taskFile, taskJSON, 0644)
-	}()
+	h.scheduler.Enqueue(job)
 
 	response := CreateTaskResponse{
 		Code:    200,
 		Message: "任务创建成功",
 	}
 	response.Data.JobID = jobID
+	response.Data.Seed = job.Seed
 
 	return c.JSON(response)
 }
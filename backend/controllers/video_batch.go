@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// 单个批次最多包含的任务数
+const maxBatchSize = 20
+
+// 批量创建任务响应
+type CreateBatchResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		BatchID string   `json:"batch_id"`
+		JobIDs  []string `json:"job_ids"`
+	} `json:"data"`
+}
+
+// 批次进度响应
+type BatchProgressResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	Data    struct {
+		BatchID   string       `json:"batch_id"`
+		Total     int          `json:"total"`
+		Finished  int          `json:"finished"` // 已结束(成功、失败或取消)的任务数
+		Succeeded int          `json:"succeeded"`
+		Failed    int          `json:"failed"`
+		Canceled  int          `json:"canceled"`
+		Completed bool         `json:"completed"`            // 批次中的任务是否已全部结束
+		VideoURLs []string     `json:"video_urls,omitempty"` // 全部结束后按创建顺序列出成功任务的GIF地址
+		Jobs      []JobSummary `json:"jobs"`
+	} `json:"data"`
+}
+
+// 生成随机批次ID
+func generateBatchID() (string, error) {
+	return generateID("batch_")
+}
+
+// formValues 读取表单中同名字段的所有值，兼容 multipart/form-data 和 x-www-form-urlencoded
+func formValues(c *fiber.Ctx, key string) []string {
+	if form, err := c.MultipartForm(); err == nil {
+		return form.Value[key]
+	}
+	var values []string
+	for _, value := range c.Request().PostArgs().PeekMulti(key) {
+		values = append(values, string(value))
+	}
+	return values
+}
+
+// batchPrompts 根据请求得到批次中每个任务的提示词:
+// 传入多个 prompts 时每个提示词一个任务，传入 prompt 和多个 variations 时每个变体一个任务
+func batchPrompts(c *fiber.Ctx, prompt string) ([]string, error) {
+	prompts := formValues(c, "prompts")
+	variations := formValues(c, "variations")
+
+	if len(prompts) > 0 && len(variations) > 0 {
+		return nil, fmt.Errorf("Use either prompts or prompt with variations, not both")
+	}
+	if len(variations) > 0 {
+		if prompt == "" {
+			return nil, fmt.Errorf("Prompt is required with variations")
+		}
+		for _, variation := range variations {
+			prompts = append(prompts, fmt.Sprintf("%s，%s", prompt, variation))
+		}
+	}
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("prompts or variations is required")
+	}
+	if len(prompts) > maxBatchSize {
+		return nil, fmt.Errorf("A batch can contain at most %d jobs", maxBatchSize)
+	}
+	return prompts, nil
+}
+
+// 批量创建视频生成任务，除提示词外的参数由批次中的所有任务共用
+func (h *VideoHandler) CreateVideoBatch(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(int64)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID in token",
+		})
+	}
+
+	base, err := parseVideoCreateRequest(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	prompts, err := batchPrompts(c, base.Prompt)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// 先校验所有任务，任何一个不合法时整个批次都不创建
+	requests := make([]VideoCreateRequest, len(prompts))
+	for i, prompt := range prompts {
+		req := base
+		req.Prompt = prompt
+		if err := validateVideoCreateRequest(&req, h.catalog); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Job %d: %s", i+1, err.Error()),
+			})
+		}
+		requests[i] = req
+	}
+
+	batchID, err := generateBatchID()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate batch ID",
+		})
+	}
+
+	batch := &models.JobBatch{
+		BatchID: batchID,
+		UserID:  userID,
+		Total:   len(requests),
+	}
+	if err := h.batchRepo.Create(batch); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save batch: " + err.Error(),
+		})
+	}
+
+	// 批次中的任务共用同一张输入图片，创建失败时遗留的图片由清理服务删除
+	var imagePath string
+	if requests[0].Image != nil {
+		if imagePath, err = services.SaveInputImage(requests[0].Image); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	jobs := make([]*models.Job, 0, len(requests))
+	for i := range requests {
+		jobID, err := generateJobID()
+		if err == nil {
+			job := newJobFromRequest(jobID, userID, &requests[i])
+			job.BatchID = batchID
+			job.InputImagePath = imagePath
+			if err = h.jobRepo.Create(job); err == nil {
+				jobs = append(jobs, job)
+				continue
+			}
+		}
+
+		// 已创建的任务尚未提交，连同批次一起删除，避免留下不完整的批次
+		for _, job := range jobs {
+			if err := h.jobRepo.Delete(job); err != nil {
+				log.Printf("删除批次 %s 中的任务 %s 失败: %v", batchID, job.JobID, err)
+			}
+		}
+		if err := h.batchRepo.Delete(batchID); err != nil {
+			log.Printf("删除批次 %s 失败: %v", batchID, err)
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save job: " + err.Error(),
+		})
+	}
+
+	response := CreateBatchResponse{
+		Code:    200,
+		Message: "批次创建成功",
+	}
+	response.Data.BatchID = batchID
+	for _, job := range jobs {
+		// 加入提交队列，由调度器在有空闲名额时提交到视频生成服务
+		h.scheduler.Enqueue(job)
+		response.Data.JobIDs = append(response.Data.JobIDs, job.JobID)
+	}
+
+	return c.JSON(response)
+}
+
+// 查询批次的整体进度和每个任务的状态
+func (h *VideoHandler) GetVideoBatch(c *fiber.Ctx) error {
+	batchID := c.Params("batch_id")
+	if batchID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Batch ID is required",
+		})
+	}
+
+	userID, ok := c.Locals("userID").(int64)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID in token",
+		})
+	}
+
+	batch, err := h.batchRepo.FindByBatchIDForUser(batchID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load batch",
+		})
+	}
+	if batch == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Batch not found",
+		})
+	}
+
+	jobs, err := h.jobRepo.FindByBatchID(batchID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load batch jobs",
+		})
+	}
+
+	response := BatchProgressResponse{Code: 200}
+	response.Data.BatchID = batch.BatchID
+	response.Data.Total = batch.Total
+	response.Data.Jobs = []JobSummary{}
+	for _, job := range jobs {
+		switch job.Status {
+		case models.TaskSucceeded:
+			response.Data.Succeeded++
+		case models.TaskFailed:
+			response.Data.Failed++
+		case models.TaskCanceled:
+			response.Data.Canceled++
+		}
+		if job.IsTerminal() {
+			response.Data.Finished++
+		}
+		response.Data.Jobs = append(response.Data.Jobs, newJobSummary(job))
+	}
+
+	// 已被清理的任务不再计入，剩余任务都结束即视为批次完成
+	response.Data.Completed = response.Data.Finished == len(jobs)
+	if response.Data.Completed {
+		for _, job := range jobs {
+			if job.Status == models.TaskSucceeded {
+				response.Data.VideoURLs = append(response.Data.VideoURLs, job.OutputURL)
+			}
+		}
+	}
+
+	return c.JSON(response)
+}
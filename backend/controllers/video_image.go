@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"emoji-maker-backend/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// readInputImage 读取并校验图生视频的输入图片，未传入图片时返回nil
+// 优先使用multipart上传的image文件，同时兼容旧客户端通过img_base64字段传入的Base64数据
+func readInputImage(c *fiber.Ctx) (*services.InputImage, error) {
+	encoded := c.FormValue("img_base64")
+	file, err := c.FormFile("image")
+	if err != nil {
+		// 没有上传文件
+		if encoded == "" {
+			return nil, nil
+		}
+		data, err := decodeBase64Image(encoded)
+		if err != nil {
+			return nil, err
+		}
+		return services.ParseInputImage(data)
+	}
+	if encoded != "" {
+		return nil, fmt.Errorf("Use either image or img_base64, not both")
+	}
+
+	maxBytes := services.MaxInputImageBytes()
+	if file.Size > maxBytes {
+		return nil, fmt.Errorf("Image must be at most %d MB", maxBytes/1024/1024)
+	}
+	f, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read image: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read image: %v", err)
+	}
+	return services.ParseInputImage(data)
+}
+
+// decodeBase64Image 解码Base64图片，支持 data:image/...;base64, 前缀和带换行的编码
+func decodeBase64Image(encoded string) ([]byte, error) {
+	if strings.HasPrefix(encoded, "data:") {
+		header, data, found := strings.Cut(encoded, ",")
+		if !found || !strings.HasSuffix(header, ";base64") {
+			return nil, fmt.Errorf("Invalid img_base64: data URL must be base64 encoded")
+		}
+		encoded = data
+	}
+	// Android的Base64.DEFAULT每76个字符插入换行
+	encoded = strings.Join(strings.Fields(encoded), "")
+
+	if int64(base64.StdEncoding.DecodedLen(len(encoded))) > services.MaxInputImageBytes()+2 {
+		return nil, fmt.Errorf("Image must be at most %d MB", services.MaxInputImageBytes()/1024/1024)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		// 兼容省略了末尾填充的编码
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "=")); err != nil {
+			return nil, fmt.Errorf("Invalid img_base64: %v", err)
+		}
+	}
+	return data, nil
+}
+
+// 预览输入图片的预处理结果，返回提交给模型的画面(JPEG)，不创建任务
+// 参数与创建图生视频任务相同: image 或 img_base64、resolution、aspect_ratio、fit
+func (h *VideoHandler) PreviewInputImage(c *fiber.Ctx) error {
+	img, err := readInputImage(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if img == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "image is required",
+		})
+	}
+	resolution := c.FormValue("resolution")
+	if resolution == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Resolution is required",
+		})
+	}
+
+	processed, err := services.PreprocessInputImage(img, services.ImageOptions{
+		Resolution:  resolution,
+		AspectRatio: c.FormValue("aspect_ratio"),
+		Fit:         c.FormValue("fit"),
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, processed.MIME)
+	c.Set("X-Image-Width", strconv.Itoa(processed.Width))
+	c.Set("X-Image-Height", strconv.Itoa(processed.Height))
+	return c.Send(processed.Data)
+}
+
+// 获取任务预处理后提交给模型的输入图片，只能获取自己创建的任务的图片
+func (h *VideoHandler) GetInputImage(c *fiber.Ctx) error {
+	job, handled, err := h.loadOwnedJob(c)
+	if handled {
+		return err
+	}
+	if job.InputImagePath == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Input image not found",
+		})
+	}
+
+	data, err := os.ReadFile(job.InputImagePath)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Input image not found",
+		})
+	}
+	c.Set(fiber.HeaderContentType, http.DetectContentType(data))
+	return c.Send(data)
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"emoji-maker-backend/config"
+	"emoji-maker-backend/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxSeed 随机种子的最大值，与DashScope允许的范围一致
+const maxSeed = 2147483647
+
+// 生成参数，创建任务的各个接口共用
+type GenerationParams struct {
+	Duration     int  `json:"duration"`      // 视频时长(秒)，0表示使用模型的默认时长
+	Seed         *int `json:"seed"`          // 随机种子，不传时由服务端随机生成
+	PromptExtend bool `json:"prompt_extend"` // 是否由模型扩写提示词，默认开启
+	Watermark    bool `json:"watermark"`     // 是否添加水印，默认关闭
+}
+
+// parseGenerationParams 从 form-data 中解析生成参数，未传的参数使用默认值
+func parseGenerationParams(c *fiber.Ctx) (GenerationParams, error) {
+	params := GenerationParams{PromptExtend: true}
+
+	if value := c.FormValue("duration"); value != "" {
+		duration, err := strconv.Atoi(value)
+		if err != nil {
+			return params, fmt.Errorf("Invalid duration")
+		}
+		params.Duration = duration
+	}
+	if value := c.FormValue("seed"); value != "" {
+		seed, err := strconv.Atoi(value)
+		if err != nil {
+			return params, fmt.Errorf("Invalid seed")
+		}
+		params.Seed = &seed
+	}
+	if value := c.FormValue("prompt_extend"); value != "" {
+		promptExtend, err := strconv.ParseBool(value)
+		if err != nil {
+			return params, fmt.Errorf("Invalid prompt_extend")
+		}
+		params.PromptExtend = promptExtend
+	}
+	if value := c.FormValue("watermark"); value != "" {
+		watermark, err := strconv.ParseBool(value)
+		if err != nil {
+			return params, fmt.Errorf("Invalid watermark")
+		}
+		params.Watermark = watermark
+	}
+	return params, nil
+}
+
+// validateGenerationParams 校验生成参数是否在模型的限制范围内
+func validateGenerationParams(model *config.VideoModel, params *GenerationParams) error {
+	if params.Duration < 0 {
+		return fmt.Errorf("Duration must be positive")
+	}
+	if model.MaxDuration > 0 && params.Duration > model.MaxDuration {
+		return fmt.Errorf("Duration must be at most %d seconds for model %s", model.MaxDuration, model.Name)
+	}
+	if params.Seed != nil && (*params.Seed < 0 || *params.Seed > maxSeed) {
+		return fmt.Errorf("Seed must be between 0 and %d", maxSeed)
+	}
+	return nil
+}
+
+// applyTo 将生成参数写入任务，未指定随机种子时为每个任务单独生成，保证实际使用的种子可以返回给用户
+func (p *GenerationParams) applyTo(job *models.Job) {
+	job.Duration = p.Duration
+	if p.Seed != nil {
+		job.Seed = *p.Seed
+	} else {
+		job.Seed = randomSeed()
+	}
+	job.PromptExtend = p.PromptExtend
+	job.Watermark = p.Watermark
+}
+
+// randomSeed 生成范围内的随机种子
+func randomSeed() int {
+	bytes := make([]byte, 4)
+	rand.Read(bytes)
+	return int(binary.BigEndian.Uint32(bytes) & maxSeed)
+}
@@ -1,7 +1,9 @@
 package middleware
 
 import (
+	"emoji-maker-backend/config"
 	"emoji-maker-backend/services"
+	"slices"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -51,3 +53,30 @@ func Protected() fiber.Handler {
 		return c.Next()
 	}
 }
+
+// QueryToken 允许通过token查询参数传递JWT，需放在Protected之前
+// 浏览器的EventSource无法设置请求头，SSE接口通过该方式认证
+func QueryToken() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Get("Authorization") == "" {
+			if token := c.Query("token"); token != "" {
+				c.Request().Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		return c.Next()
+	}
+}
+
+// AdminOnly 只允许配置中的管理员访问，需放在Protected之后
+func AdminOnly() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, ok := c.Locals("userID").(int64)
+		if !ok || !slices.Contains(config.AppConfig.Admin.UserIDs, userID) {
+			return c.Status(fiber.StatusForbidden).JSON(services.APIResponse{
+				Code:    1,
+				Message: "Admin permission required",
+			})
+		}
+		return c.Next()
+	}
+}
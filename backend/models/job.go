@@ -0,0 +1,114 @@
+package models
+
+import "time"
+
+// 任务状态枚举
+const (
+	TaskPending    = "PENDING"
+	TaskRunning    = "RUNNING"
+	TaskConverting = "CONVERTING" // 视频已生成，正在本地转换为GIF
+	TaskSucceeded  = "SUCCEEDED"
+	TaskFailed     = "FAILED"
+	TaskCanceled   = "CANCELED" // 用户取消，不会再生成GIF
+	TaskUnknown    = "UNKNOWN"
+)
+
+// ActiveStatuses 尚未结束的任务状态
+var ActiveStatuses = []string{TaskPending, TaskRunning, TaskConverting}
+
+// TerminalStatuses 已结束的任务状态
+var TerminalStatuses = []string{TaskSucceeded, TaskFailed, TaskCanceled}
+
+// 任务类型枚举
+const (
+	JobTypeTextToVideo   = "text_to_video"
+	JobTypeImageToVideo  = "image_to_video"
+	JobTypePromptToVideo = "prompt_to_video" // 经过文本模型处理提示词的文生视频
+)
+
+// 任务处理步骤，用于记录失败发生在哪一步，重试时从该步骤继续
+const (
+	JobStepSubmit   = "submit"   // 提交到视频生成服务
+	JobStepQuery    = "query"    // 查询上游任务状态
+	JobStepGenerate = "generate" // 上游生成视频
+	JobStepDownload = "download" // 下载生成的视频
+	JobStepConvert  = "convert"  // 本地转换GIF
+)
+
+// JobError 任务某一次执行失败的记录
+type JobError struct {
+	Attempt int       `json:"attempt"` // 第几次执行，从0开始，等于失败时的重试次数
+	Step    string    `json:"step"`
+	Error   string    `json:"error"`
+	At      time.Time `json:"at"`
+}
+
+// Job 视频生成任务模型
+type Job struct {
+	ID             int64      `xorm:"id pk autoincr" json:"-"`
+	JobID          string     `xorm:"job_id unique notnull" json:"job_id"`
+	UserID         int64      `xorm:"user_id index notnull" json:"-"` // 创建任务的用户
+	Type           string     `xorm:"type index" json:"type"`
+	Status         string     `xorm:"status index" json:"status"`
+	Model          string     `xorm:"model" json:"model"`
+	Prompt         string     `xorm:"prompt text" json:"prompt"`
+	NegativePrompt string     `xorm:"negative_prompt text" json:"negative_prompt,omitempty"`
+	RolePrompt     string     `xorm:"role_prompt text" json:"role_prompt,omitempty"`     // 文本模型根据角色生成的描述，用于拼接最终提示词
+	OrigPrompt     string     `xorm:"orig_prompt text" json:"orig_prompt,omitempty"`     // 上游记录的原始提示词
+	ActualPrompt   string     `xorm:"actual_prompt text" json:"actual_prompt,omitempty"` // 开启提示词扩写时上游实际使用的提示词
+	Size           string     `xorm:"size" json:"size,omitempty"`
+	Resolution     string     `xorm:"resolution" json:"resolution,omitempty"`
+	Duration       int        `xorm:"duration" json:"duration,omitempty"`                        // 视频时长(秒)，0表示使用模型的默认时长
+	Seed           int        `xorm:"seed" json:"seed"`                                          // 实际使用的随机种子
+	PromptExtend   bool       `xorm:"prompt_extend notnull default 1" json:"prompt_extend"`      // 是否由模型扩写提示词
+	Watermark      bool       `xorm:"watermark" json:"watermark"`                                // 是否添加水印
+	TextModel      string     `xorm:"text_model" json:"text_model,omitempty"`                    // 处理提示词使用的文本模型
+	TextTokens     int        `xorm:"text_tokens" json:"text_tokens,omitempty"`                  // 处理提示词消耗的token数
+	VideoSeconds   int        `xorm:"video_seconds" json:"video_seconds,omitempty"`              // 上游生成的视频总时长(秒)，多次重新提交时累加
+	Cost           float64    `xorm:"cost" json:"cost,omitempty"`                                // 估算的累计费用(元)，包括文本模型和每次生成视频的费用
+	ImgURL         string     `xorm:"img_url text" json:"-"`                                     // 旧版本直接保存的Base64输入图片，新任务的图片保存在InputImagePath
+	InputImagePath string     `xorm:"input_image_path" json:"-"`                                 // 图生视频输入图片在本地的路径，不对外公开
+	CallbackURL    string     `xorm:"callback_url text" json:"callback_url,omitempty"`           // 任务结束时回调的地址
+	IdempotencyKey string     `xorm:"idempotency_key index" json:"-"`                            // 客户端传入的Idempotency-Key
+	RequestHash    string     `xorm:"request_hash" json:"-"`                                     // 创建请求参数的摘要，用于识别重复使用幂等键但参数不同的请求
+	BatchID        string     `xorm:"batch_id index" json:"batch_id,omitempty"`                  // 批量创建时所属的批次
+	UpstreamTaskID string     `xorm:"dashscope_task_id index" json:"upstream_task_id,omitempty"` // 视频生成服务的任务ID，沿用最初接入DashScope时的列名
+	VideoURL       string     `xorm:"video_url text" json:"-"`                                   // 视频生成服务返回的原始视频地址
+	OutputURL      string     `xorm:"output_url text" json:"output_url,omitempty"`
+	OutputPath     string     `xorm:"output_path" json:"-"`      // GIF在本地的存储路径，文件名随机生成，与任务ID无关
+	VideoExpiresAt time.Time  `xorm:"video_expires_at" json:"-"` // 原始视频地址的过期时间
+	Error          string     `xorm:"error text" json:"error,omitempty"`
+	FailedStep     string     `xorm:"failed_step" json:"failed_step,omitempty"`
+	RetryCount     int        `xorm:"retry_count" json:"retry_count"`
+	PollFailures   int        `xorm:"poll_failures" json:"-"` // 连续查询上游任务状态失败的次数，查询成功后清零
+	ErrorHistory   []JobError `xorm:"error_history json" json:"error_history,omitempty"`
+	Version        int64      `xorm:"version notnull default 1" json:"-"` // 乐观锁版本号，每次更新加1，任务读出后被其他流程修改过时更新失败
+	CreatedAt      time.Time  `xorm:"created_at created" json:"created_at"`
+	UpdatedAt      time.Time  `xorm:"updated_at updated" json:"updated_at"`
+	FinishedAt     time.Time  `xorm:"finished_at" json:"finished_at"`
+
+	transitions []JobTransition // 尚未保存的状态转换记录
+}
+
+// IsTerminal 任务是否已处于终态
+func (j *Job) IsTerminal() bool {
+	return j.Status == TaskSucceeded || j.Status == TaskFailed || j.Status == TaskCanceled
+}
+
+// Fail 将任务标记为失败，并把错误追加到错误历史中，任务已处于最终状态时返回错误
+func (j *Job) Fail(step, errMsg string) error {
+	if err := j.TransitionTo(TaskFailed, step, errMsg); err != nil {
+		return err
+	}
+	now := time.Now()
+	j.Error = errMsg
+	j.FailedStep = step
+	j.FinishedAt = now
+	j.ErrorHistory = append(j.ErrorHistory, JobError{
+		Attempt: j.RetryCount,
+		Step:    step,
+		Error:   errMsg,
+		At:      now,
+	})
+	return nil
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// JobBatch 批量创建的一组视频任务，例如同一个表情包的多张贴纸
+type JobBatch struct {
+	ID        int64     `xorm:"id pk autoincr" json:"-"`
+	BatchID   string    `xorm:"batch_id unique notnull" json:"batch_id"`
+	UserID    int64     `xorm:"user_id index notnull" json:"-"` // 创建批次的用户
+	Total     int       `xorm:"total" json:"total"`             // 批次中的任务数
+	CreatedAt time.Time `xorm:"created_at created" json:"created_at"`
+}
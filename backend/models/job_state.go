@@ -0,0 +1,73 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// 任务生命周期中由用户或服务触发的步骤，只用于状态转换记录
+const (
+	JobStepCreate = "create" // 创建任务
+	JobStepCancel = "cancel" // 用户取消
+	JobStepRetry  = "retry"  // 用户重试
+)
+
+// jobTransitions 任务状态机允许的状态转换，SUCCEEDED和CANCELED是最终状态，FAILED只能通过重试回到进行中
+var jobTransitions = map[string][]string{
+	TaskPending:    {TaskRunning, TaskConverting, TaskFailed, TaskCanceled},
+	TaskRunning:    {TaskPending, TaskConverting, TaskFailed, TaskCanceled},
+	TaskConverting: {TaskSucceeded, TaskFailed, TaskCanceled},
+	TaskFailed:     {TaskPending, TaskRunning, TaskConverting},
+}
+
+// CanTransition 状态机是否允许从from转换到to，状态不变视为允许
+func CanTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, next := range jobTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// JobTransition 任务的一次状态转换记录
+type JobTransition struct {
+	ID     int64     `xorm:"id pk autoincr" json:"-"`
+	JobID  string    `xorm:"job_id index notnull" json:"-"`
+	From   string    `xorm:"from_status" json:"from"` // 创建任务时为空
+	To     string    `xorm:"to_status" json:"to"`
+	Step   string    `xorm:"step" json:"step"`
+	Reason string    `xorm:"reason text" json:"reason,omitempty"`
+	At     time.Time `xorm:"at" json:"at"`
+}
+
+// TransitionTo 按状态机将任务转换到新状态并记录转换的步骤和原因，非法转换返回错误且不修改任务
+// 转换记录在任务保存成功后由仓库写入，任务状态只应通过该方法修改
+func (j *Job) TransitionTo(to, step, reason string) error {
+	if !CanTransition(j.Status, to) {
+		return fmt.Errorf("illegal job status transition %s -> %s", j.Status, to)
+	}
+	if j.Status == to {
+		return nil
+	}
+	j.transitions = append(j.transitions, JobTransition{
+		JobID:  j.JobID,
+		From:   j.Status,
+		To:     to,
+		Step:   step,
+		Reason: reason,
+		At:     time.Now(),
+	})
+	j.Status = to
+	return nil
+}
+
+// TakeTransitions 取出尚未保存的状态转换记录
+func (j *Job) TakeTransitions() []JobTransition {
+	transitions := j.transitions
+	j.transitions = nil
+	return transitions
+}
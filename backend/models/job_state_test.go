@@ -0,0 +1,58 @@
+package models
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[string][]string{
+		TaskPending:    {TaskPending, TaskRunning, TaskConverting, TaskFailed, TaskCanceled},
+		TaskRunning:    {TaskRunning, TaskPending, TaskConverting, TaskFailed, TaskCanceled},
+		TaskConverting: {TaskConverting, TaskSucceeded, TaskFailed, TaskCanceled},
+		TaskSucceeded:  {TaskSucceeded},
+		TaskFailed:     {TaskFailed, TaskPending, TaskRunning, TaskConverting},
+		TaskCanceled:   {TaskCanceled},
+	}
+	statuses := []string{TaskPending, TaskRunning, TaskConverting, TaskSucceeded, TaskFailed, TaskCanceled}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := slices.Contains(allowed[from], to)
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestJobTransitionTo(t *testing.T) {
+	job := &Job{JobID: "job_a", Status: TaskPending}
+	if err := job.TransitionTo(TaskRunning, JobStepSubmit, "submit"); err != nil {
+		t.Fatalf("TransitionTo(RUNNING) error = %v", err)
+	}
+	if err := job.Fail(JobStepQuery, "upstream error"); err != nil {
+		t.Fatalf("Fail() error = %v", err)
+	}
+	if job.Status != TaskFailed || job.FailedStep != JobStepQuery || len(job.ErrorHistory) != 1 {
+		t.Errorf("after Fail: status %s, failed step %s, %d errors", job.Status, job.FailedStep, len(job.ErrorHistory))
+	}
+
+	// 非法转换返回错误且不修改任务
+	if err := job.TransitionTo(TaskSucceeded, JobStepConvert, "done"); err == nil {
+		t.Error("TransitionTo(FAILED -> SUCCEEDED) error = nil, want error")
+	}
+	if job.Status != TaskFailed {
+		t.Errorf("status after illegal transition = %s, want %s", job.Status, TaskFailed)
+	}
+
+	transitions := job.TakeTransitions()
+	if len(transitions) != 2 {
+		t.Fatalf("recorded %d transitions, want 2", len(transitions))
+	}
+	if transitions[0].From != TaskPending || transitions[0].To != TaskRunning || transitions[1].From != TaskRunning || transitions[1].To != TaskFailed {
+		t.Errorf("transitions = %+v", transitions)
+	}
+	if len(job.TakeTransitions()) != 0 {
+		t.Error("TakeTransitions() returned records twice")
+	}
+}
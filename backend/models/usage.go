@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// 用量类型
+const (
+	UsageKindVideo = "video" // 上游生成视频
+	UsageKindText  = "text"  // 文本模型处理提示词
+)
+
+// UsageRecord 一次计费的上游调用，视频在上游生成成功时记录，文本模型在处理提示词后记录
+// 与任务分开保存，任务被定期清理后用量仍然保留
+type UsageRecord struct {
+	ID             int64     `xorm:"id pk autoincr" json:"-"`
+	UserID         int64     `xorm:"user_id index notnull" json:"-"`
+	JobID          string    `xorm:"job_id index" json:"job_id"`
+	Kind           string    `xorm:"kind" json:"kind"`
+	Model          string    `xorm:"model" json:"model"`
+	UpstreamTaskID string    `xorm:"upstream_task_id" json:"-"`
+	VideoSeconds   int       `xorm:"video_seconds" json:"video_seconds,omitempty"` // 生成的视频总时长(秒)
+	VideoCount     int       `xorm:"video_count" json:"video_count,omitempty"`
+	VideoSR        int       `xorm:"video_sr" json:"video_sr,omitempty"`       // 视频的清晰度档位，例如480、720
+	VideoRatio     string    `xorm:"video_ratio" json:"video_ratio,omitempty"` // 视频的宽高比或分辨率
+	TextTokens     int       `xorm:"text_tokens" json:"text_tokens,omitempty"`
+	Cost           float64   `xorm:"cost" json:"cost"` // 按模型目录中的价格估算的费用(元)
+	CreatedAt      time.Time `xorm:"created_at created index" json:"created_at"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// WebhookDelivery 任务结束回调的单次投递记录
+type WebhookDelivery struct {
+	ID         int64     `xorm:"id pk autoincr" json:"-"`
+	JobID      string    `xorm:"job_id index notnull" json:"job_id"`
+	URL        string    `xorm:"url text" json:"url"`
+	Status     string    `xorm:"status" json:"status"` // 投递时任务的状态
+	Attempt    int       `xorm:"attempt" json:"attempt"`
+	StatusCode int       `xorm:"status_code" json:"status_code,omitempty"`
+	Error      string    `xorm:"error text" json:"error,omitempty"`
+	Success    bool      `xorm:"success" json:"success"`
+	DurationMs int64     `xorm:"duration_ms" json:"duration_ms"`
+	CreatedAt  time.Time `xorm:"created_at created" json:"created_at"`
+}
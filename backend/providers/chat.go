@@ -0,0 +1,229 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ChatMessage 对话中的一条消息
+type ChatMessage struct {
+	Role    string `json:"role"` // system、user 或 assistant
+	Content string `json:"content"`
+}
+
+// ChatRequest 对话补全请求
+type ChatRequest struct {
+	Model    string
+	Messages []ChatMessage
+	Search   bool // 是否先联网搜索再回答，DashScope兼容模式的扩展参数
+}
+
+// ChatUsage 对话补全消耗的token数
+type ChatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ChatResponse 对话补全结果
+type ChatResponse struct {
+	Content string
+	Usage   ChatUsage
+}
+
+// ChatClient 文本模型对话补全接口，兼容OpenAI的chat/completions协议，
+// 测试时可以实现该接口或将base_url指向本地的模拟服务
+type ChatClient interface {
+	// Complete 一次性返回完整的回答
+	Complete(ctx context.Context, req ChatRequest) (*ChatResponse, error)
+	// Stream 以流式方式返回回答，每收到一段增量内容调用一次onDelta，onDelta返回错误时中止，
+	// 结束后返回拼接好的完整回答
+	Stream(ctx context.Context, req ChatRequest, onDelta func(delta string) error) (*ChatResponse, error)
+}
+
+// openAIChatClient OpenAI兼容的对话补全客户端
+type openAIChatClient struct {
+	baseURL string
+	apiKey  string
+	client  UpstreamClient
+}
+
+// NewOpenAIChatClient 创建OpenAI兼容的对话补全客户端实例，超时、重试和熔断由client负责
+func NewOpenAIChatClient(baseURL, apiKey string, client UpstreamClient) ChatClient {
+	return &openAIChatClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  client,
+	}
+}
+
+// chatCompletionRequest chat/completions请求体
+type chatCompletionRequest struct {
+	Model         string         `json:"model"`
+	Messages      []ChatMessage  `json:"messages"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+	EnableSearch  bool           `json:"enable_search,omitempty"`
+	ForcedSearch  bool           `json:"forced_search,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// chatCompletionResponse chat/completions响应体，流式响应的每个数据块也使用该结构
+type chatCompletionResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *ChatUsage     `json:"usage,omitempty"`
+	Error *chatErrorBody `json:"error,omitempty"`
+}
+
+// chatErrorBody OpenAI兼容接口的错误响应
+type chatErrorBody struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+}
+
+// Complete 发送非流式请求
+func (c *openAIChatClient) Complete(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	response, err := c.post(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read chat completion response: %v", err)
+	}
+	var completion chatCompletionResponse
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return nil, fmt.Errorf("Failed to parse chat completion response: %v", err)
+	}
+	if completion.Error != nil {
+		return nil, completion.Error.toError(response.StatusCode)
+	}
+	if len(completion.Choices) == 0 {
+		return nil, fmt.Errorf("No content in chat completion response")
+	}
+
+	result := &ChatResponse{Content: completion.Choices[0].Message.Content}
+	if completion.Usage != nil {
+		result.Usage = *completion.Usage
+	}
+	return result, nil
+}
+
+// Stream 发送流式请求并逐行解析SSE数据块，要求服务端在最后一个数据块中返回用量
+func (c *openAIChatClient) Stream(ctx context.Context, req ChatRequest, onDelta func(delta string) error) (*ChatResponse, error) {
+	response, err := c.post(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var content strings.Builder
+	result := &ChatResponse{}
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk chatCompletionResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("Failed to parse chat completion chunk: %v", err)
+		}
+		if chunk.Error != nil {
+			return nil, chunk.Error.toError(response.StatusCode)
+		}
+		if chunk.Usage != nil {
+			result.Usage = *chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			content.WriteString(choice.Delta.Content)
+			if err := onDelta(choice.Delta.Content); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read chat completion stream: %v", err)
+	}
+
+	result.Content = content.String()
+	return result, nil
+}
+
+// post 发送chat/completions请求，非2xx响应解析为*Error返回
+func (c *openAIChatClient) post(ctx context.Context, req ChatRequest, stream bool) (*http.Response, error) {
+	payload := chatCompletionRequest{
+		Model:        req.Model,
+		Messages:     req.Messages,
+		EnableSearch: req.Search,
+		ForcedSearch: req.Search,
+	}
+	if stream {
+		payload.Stream = true
+		payload.StreamOptions = &streamOptions{IncludeUsage: true}
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/chat/completions", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to call chat completion API: %w", err)
+	}
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response, nil
+	}
+
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	var completion chatCompletionResponse
+	if err := json.Unmarshal(body, &completion); err == nil && completion.Error != nil {
+		return nil, completion.Error.toError(response.StatusCode)
+	}
+	return nil, &Error{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
+// toError 将错误响应转换为统一的*Error
+func (e *chatErrorBody) toError(statusCode int) error {
+	code := e.Code
+	if code == "" {
+		code = e.Type
+	}
+	return &Error{StatusCode: statusCode, Code: code, Message: e.Message}
+}
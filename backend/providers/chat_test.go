@@ -0,0 +1,104 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// newTestChatClient 创建指向测试服务器的对话补全客户端
+func newTestChatClient(t *testing.T, handler http.HandlerFunc) ChatClient {
+	server, _ := countingServer(t, handler)
+	return NewOpenAIChatClient(server.URL+"/", "test-key", NewUpstreamClient("test", testUpstreamOptions()))
+}
+
+// decodeChatRequest 解析并检查发送的请求
+func decodeChatRequest(t *testing.T, r *http.Request) chatCompletionRequest {
+	t.Helper()
+	if r.URL.Path != "/chat/completions" {
+		t.Errorf("path = %s, want /chat/completions", r.URL.Path)
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+		t.Errorf("Authorization = %q, want Bearer test-key", got)
+	}
+	var payload chatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		t.Errorf("request body is not JSON: %v", err)
+	}
+	return payload
+}
+
+func TestChatClientComplete(t *testing.T) {
+	client := newTestChatClient(t, func(w http.ResponseWriter, r *http.Request) {
+		payload := decodeChatRequest(t, r)
+		if payload.Model != "qwen-plus" || len(payload.Messages) != 2 || !payload.EnableSearch || payload.Stream {
+			t.Errorf("payload = %+v", payload)
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"你好"}}],"usage":{"prompt_tokens":10,"completion_tokens":2,"total_tokens":12}}`)
+	})
+
+	response, err := client.Complete(context.Background(), ChatRequest{
+		Model:    "qwen-plus",
+		Messages: []ChatMessage{{Role: "system", Content: "sys"}, {Role: "user", Content: "hi"}},
+		Search:   true,
+	})
+	if err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	if response.Content != "你好" || response.Usage.TotalTokens != 12 {
+		t.Errorf("Complete() = %+v", response)
+	}
+}
+
+func TestChatClientStream(t *testing.T) {
+	client := newTestChatClient(t, func(w http.ResponseWriter, r *http.Request) {
+		payload := decodeChatRequest(t, r)
+		if !payload.Stream || payload.StreamOptions == nil || !payload.StreamOptions.IncludeUsage {
+			t.Errorf("payload = %+v, want a stream request that includes usage", payload)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"一只\"}}]}\n\n")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"猫\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":2,\"total_tokens\":7}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	var deltas []string
+	response, err := client.Stream(context.Background(), ChatRequest{Model: "qwen-plus"}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if len(deltas) != 2 || response.Content != "一只猫" || response.Usage.TotalTokens != 7 {
+		t.Errorf("Stream() = %+v with deltas %q", response, deltas)
+	}
+
+	// onDelta返回错误时中止
+	stop := errors.New("client gone")
+	if _, err := client.Stream(context.Background(), ChatRequest{Model: "qwen-plus"}, func(string) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("Stream() with failing onDelta error = %v, want %v", err, stop)
+	}
+}
+
+func TestChatClientErrorResponse(t *testing.T) {
+	client := newTestChatClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":{"message":"Model not exist.","type":"invalid_request_error","code":"model_not_found"}}`)
+	})
+
+	_, err := client.Complete(context.Background(), ChatRequest{Model: "missing"})
+	var upstreamErr *Error
+	if !errors.As(err, &upstreamErr) {
+		t.Fatalf("Complete() error = %v, want *Error", err)
+	}
+	if upstreamErr.StatusCode != http.StatusBadRequest || upstreamErr.Code != "model_not_found" || upstreamErr.Message != "Model not exist." {
+		t.Errorf("Complete() error = %+v", upstreamErr)
+	}
+}
@@ -0,0 +1,242 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dashScopeSynthesisURL = "https://dashscope.aliyuncs.com/api/v1/services/aigc/video-generation/video-synthesis"
+	dashScopeTaskURL      = "https://dashscope.aliyuncs.com/api/v1/tasks/%s"
+	dashScopeCancelURL    = "https://dashscope.aliyuncs.com/api/v1/tasks/%s/cancel"
+
+	// dashScopeVideoURLTTL DashScope生成的视频地址有效期
+	dashScopeVideoURLTTL = 24 * time.Hour
+	// dashScopeTaskUnknown 任务不存在或已超过保留时间
+	dashScopeTaskUnknown = "UNKNOWN"
+)
+
+// DashScope API请求体
+type dashScopeRequest struct {
+	Model      string          `json:"model"`
+	Input      dashScopeInput  `json:"input"`
+	Parameters dashScopeParams `json:"parameters,omitempty"`
+}
+
+type dashScopeInput struct {
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	ImgURL         string `json:"img_url,omitempty"`
+}
+
+type dashScopeParams struct {
+	Size         string `json:"size,omitempty"`
+	Resolution   string `json:"resolution,omitempty"`
+	Duration     int    `json:"duration,omitempty"`
+	PromptExtend *bool  `json:"prompt_extend,omitempty"` // DashScope默认开启，关闭时需要显式传false
+	Seed         *int   `json:"seed,omitempty"`          // 0也是有效的种子
+	Watermark    bool   `json:"watermark,omitempty"`
+}
+
+// DashScope API响应体
+type dashScopeResponse struct {
+	Output struct {
+		TaskStatus string `json:"task_status"`
+		TaskID     string `json:"task_id"`
+	} `json:"output"`
+	RequestID string `json:"request_id"`
+	Code      string `json:"code,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// DashScope 查询任务结果响应
+type dashScopeQueryResponse struct {
+	RequestID string `json:"request_id"`
+	Output    struct {
+		TaskID        string `json:"task_id"`
+		TaskStatus    string `json:"task_status"`
+		SubmitTime    string `json:"submit_time"`
+		ScheduledTime string `json:"scheduled_time"`
+		EndTime       string `json:"end_time"`
+		VideoURL      string `json:"video_url,omitempty"`
+		OrigPrompt    string `json:"orig_prompt"`
+		ActualPrompt  string `json:"actual_prompt,omitempty"`
+	} `json:"output"`
+	Usage struct {
+		Duration   int    `json:"duration"`
+		VideoCount int    `json:"video_count"`
+		SR         int    `json:"SR,omitempty"`
+		VideoRatio string `json:"video_ratio,omitempty"`
+	} `json:"usage"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// dashScopeProvider 阿里云DashScope视频生成服务
+type dashScopeProvider struct {
+	apiKey string
+	client UpstreamClient
+}
+
+// NewDashScopeProvider 创建DashScope视频生成服务实例
+func NewDashScopeProvider(apiKey string, client UpstreamClient) VideoProvider {
+	return &dashScopeProvider{
+		apiKey: apiKey,
+		client: client,
+	}
+}
+
+// Name 服务名称
+func (p *dashScopeProvider) Name() string {
+	return "DashScope"
+}
+
+// Submit 以异步模式向DashScope提交视频生成任务
+func (p *dashScopeProvider) Submit(ctx context.Context, req SubmitRequest) (*SubmitResult, error) {
+	// DashScope需要能直接访问的图片，本地保存的输入图片以Base64数据地址的形式传入
+	imgURL := req.ImgURL
+	if req.ImagePath != "" {
+		var err error
+		if imgURL, err = imageDataURL(req.ImagePath); err != nil {
+			return nil, err
+		}
+	}
+
+	jsonData, err := json.Marshal(dashScopeRequest{
+		Model: req.Model,
+		Input: dashScopeInput{
+			Prompt:         req.Prompt,
+			NegativePrompt: req.NegativePrompt,
+			ImgURL:         imgURL,
+		},
+		Parameters: dashScopeParams{
+			Size:         req.Size,
+			Resolution:   req.Resolution,
+			Duration:     req.Duration,
+			PromptExtend: &req.PromptExtend,
+			Seed:         &req.Seed,
+			Watermark:    req.Watermark,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建HTTP请求
+	request, err := http.NewRequestWithContext(ctx, "POST", dashScopeSynthesisURL, strings.NewReader(string(jsonData)))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-DashScope-Async", "enable")
+
+	var dashScopeResp dashScopeResponse
+	statusCode, err := p.do(request, &dashScopeResp)
+	if err != nil {
+		return nil, err
+	}
+	if dashScopeResp.Code != "" {
+		return nil, &Error{StatusCode: statusCode, Code: dashScopeResp.Code, Message: dashScopeResp.Message}
+	}
+	return &SubmitResult{TaskID: dashScopeResp.Output.TaskID}, nil
+}
+
+// Status 查询DashScope任务的最新状态
+func (p *dashScopeProvider) Status(ctx context.Context, taskID string) (*StatusResult, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(dashScopeTaskURL, taskID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var dashScopeQueryResp dashScopeQueryResponse
+	statusCode, err := p.do(request, &dashScopeQueryResp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query DashScope task status: %w", err)
+	}
+	if dashScopeQueryResp.Code != "" && dashScopeQueryResp.Output.TaskStatus == "" {
+		return nil, &Error{StatusCode: statusCode, Code: dashScopeQueryResp.Code, Message: dashScopeQueryResp.Message}
+	}
+
+	// DashScope的任务状态与统一的状态同名，UNKNOWN表示任务不存在或已过期
+	result := &StatusResult{Status: dashScopeQueryResp.Output.TaskStatus}
+	switch result.Status {
+	case TaskPending, TaskRunning:
+	case TaskSucceeded:
+		result.VideoURL = dashScopeQueryResp.Output.VideoURL
+		result.VideoExpiresAt = time.Now().Add(dashScopeVideoURLTTL)
+		result.Usage = Usage{
+			Duration:   dashScopeQueryResp.Usage.Duration,
+			VideoCount: dashScopeQueryResp.Usage.VideoCount,
+			SR:         dashScopeQueryResp.Usage.SR,
+			VideoRatio: dashScopeQueryResp.Usage.VideoRatio,
+		}
+		result.OrigPrompt = dashScopeQueryResp.Output.OrigPrompt
+		result.ActualPrompt = dashScopeQueryResp.Output.ActualPrompt
+	case TaskFailed:
+		// 优先使用DashScope返回的详细错误信息
+		result.Message = dashScopeQueryResp.Message
+		if result.Message == "" {
+			result.Message = "Task failed on DashScope without a specific message."
+		}
+	case TaskCanceled:
+		result.Message = "Task was canceled on DashScope."
+	case dashScopeTaskUnknown:
+		return nil, fmt.Errorf("%w: DashScope task %s", ErrTaskNotFound, taskID)
+	default:
+		return nil, fmt.Errorf("Unknown DashScope task status: %s", result.Status)
+	}
+	return result, nil
+}
+
+// Cancel 请求DashScope取消任务，DashScope仅支持取消排队中(PENDING)的任务
+func (p *dashScopeProvider) Cancel(ctx context.Context, taskID string) error {
+	request, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf(dashScopeCancelURL, taskID), nil)
+	if err != nil {
+		return err
+	}
+	// 重复取消同一任务没有副作用，允许在超时和5xx时重试，该头不会发送到上游
+	request.Header["Idempotency-Key"] = nil
+
+	var dashScopeResp dashScopeResponse
+	statusCode, err := p.do(request, &dashScopeResp)
+	if err != nil {
+		return err
+	}
+	if dashScopeResp.Code != "" {
+		return &Error{StatusCode: statusCode, Code: dashScopeResp.Code, Message: dashScopeResp.Message}
+	}
+	return nil
+}
+
+// do 发送带鉴权的请求并解析JSON响应，返回HTTP状态码，DashScope的业务错误也以JSON返回，由调用方检查Code
+func (p *dashScopeProvider) do(request *http.Request, out interface{}) (int, error) {
+	request.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+	if err := json.Unmarshal(body, out); err != nil {
+		return response.StatusCode, fmt.Errorf("Failed to parse DashScope response: %v, response: %s", err, string(body))
+	}
+	return response.StatusCode, nil
+}
+
+// imageDataURL 读取本地图片并编码为Base64数据地址
+func imageDataURL(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read input image: %v", err)
+	}
+	return "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,43 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// stubUpstreamClient 直接返回指定错误或响应体的上游客户端
+type stubUpstreamClient struct {
+	err  error
+	body string
+}
+
+func (c *stubUpstreamClient) Do(request *http.Request) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(c.body))}, nil
+}
+
+func TestDashScopeStatusKeepsUpstreamError(t *testing.T) {
+	open := fmt.Errorf("%w: DashScope is unavailable", ErrCircuitOpen)
+	p := NewDashScopeProvider("test-key", &stubUpstreamClient{err: open})
+
+	// 调用方据此区分熔断和任务本身的失败
+	if _, err := p.Status(context.Background(), "task-a"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Status() error = %v, want it to wrap ErrCircuitOpen", err)
+	}
+}
+
+func TestDashScopeStatusUnknownTask(t *testing.T) {
+	body := `{"request_id":"r","output":{"task_id":"task-a","task_status":"UNKNOWN"}}`
+	p := NewDashScopeProvider("test-key", &stubUpstreamClient{body: body})
+
+	if _, err := p.Status(context.Background(), "task-a"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Status() of an expired task error = %v, want ErrTaskNotFound", err)
+	}
+}
@@ -0,0 +1,189 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// localVideoURLTTL 本地样例视频地址的有效期，与DashScope保持一致
+	localVideoURLTTL = 24 * time.Hour
+	// localDefaultDuration 未指定时长时模拟的视频时长(秒)
+	localDefaultDuration = 5
+	// localPromptSuffix 模拟提示词扩写时追加的内容
+	localPromptSuffix = "，画面细节丰富，光影自然，镜头平稳流畅。"
+)
+
+// localTask 本地模拟的上游任务
+type localTask struct {
+	submittedAt  time.Time
+	duration     int    // 模拟的视频时长，用于返回用量
+	origPrompt   string // 提交的提示词
+	actualPrompt string // 模拟扩写后的提示词
+	fail         bool   // 提交时按失败率决定任务最终是否失败
+	canceled     bool
+}
+
+// localProvider 本地模拟的视频生成服务，不需要DashScope密钥和外网，用于开发和CI
+// 任务提交后在前一半延迟内处于PENDING，之后处于RUNNING，延迟结束后按失败率变为SUCCEEDED或FAILED，
+// 成功的任务返回本机回环地址上的样例MP4，走完整的下载和GIF转换流程
+// 任务只保存在内存中，服务重启后之前提交的任务查询时返回ErrTaskNotFound
+type localProvider struct {
+	delay       time.Duration
+	failureRate float64
+	videoURL    string
+
+	mu    sync.Mutex
+	tasks map[string]*localTask
+}
+
+// NewLocalProvider 创建本地模拟的视频生成服务实例，启动时用ffmpeg生成样例视频并在回环地址上提供下载
+func NewLocalProvider(delay time.Duration, failureRate float64) (VideoProvider, error) {
+	samplePath := filepath.Join(os.TempDir(), "emoji-maker-local-sample.mp4")
+	if err := generateSampleVideo(samplePath); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen for local sample video: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sample.mp4", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, samplePath)
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("本地样例视频服务退出: %v", err)
+		}
+	}()
+
+	return &localProvider{
+		delay:       delay,
+		failureRate: failureRate,
+		videoURL:    "http://" + listener.Addr().String() + "/sample.mp4",
+		tasks:       make(map[string]*localTask),
+	}, nil
+}
+
+// generateSampleVideo 用ffmpeg的测试信号源生成一段短视频
+func generateSampleVideo(path string) error {
+	cmd := exec.Command("ffmpeg", "-y", "-f", "lavfi", "-i", "testsrc=size=480x480:rate=16:duration=3", "-pix_fmt", "yuv420p", path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("样例视频生成失败: %v %s", err, string(output))
+		return fmt.Errorf("Failed to generate local sample video: %v", err)
+	}
+	return nil
+}
+
+// Name 服务名称
+func (p *localProvider) Name() string {
+	return "本地模拟服务"
+}
+
+// Submit 登记模拟任务并立即返回任务ID
+func (p *localProvider) Submit(ctx context.Context, req SubmitRequest) (*SubmitResult, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return nil, err
+	}
+	taskID := "local-" + hex.EncodeToString(bytes)
+
+	// 与DashScope一样在提交时读取输入图片
+	if req.ImagePath != "" {
+		if _, err := os.Stat(req.ImagePath); err != nil {
+			return nil, fmt.Errorf("Failed to read input image: %v", err)
+		}
+	}
+
+	fail, err := p.roll()
+	if err != nil {
+		return nil, err
+	}
+
+	duration := req.Duration
+	if duration == 0 {
+		duration = localDefaultDuration
+	}
+
+	task := &localTask{submittedAt: time.Now(), duration: duration, origPrompt: req.Prompt, fail: fail}
+	if req.PromptExtend {
+		task.actualPrompt = strings.TrimRight(req.Prompt, "。.") + localPromptSuffix
+	}
+
+	p.mu.Lock()
+	p.tasks[taskID] = task
+	p.mu.Unlock()
+	return &SubmitResult{TaskID: taskID}, nil
+}
+
+// roll 按失败率随机决定任务是否失败
+func (p *localProvider) roll() (bool, error) {
+	if p.failureRate <= 0 {
+		return false, nil
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return false, err
+	}
+	return float64(n.Int64())/1000000 < p.failureRate, nil
+}
+
+// Status 根据提交后经过的时间计算模拟任务的状态
+func (p *localProvider) Status(ctx context.Context, taskID string) (*StatusResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	task, ok := p.tasks[taskID]
+	if !ok {
+		return nil, fmt.Errorf("%w: local task %s", ErrTaskNotFound, taskID)
+	}
+
+	elapsed := time.Since(task.submittedAt)
+	switch {
+	case task.canceled:
+		return &StatusResult{Status: TaskCanceled, Message: "Task was canceled on local provider."}, nil
+	case elapsed < p.delay/2:
+		return &StatusResult{Status: TaskPending}, nil
+	case elapsed < p.delay:
+		return &StatusResult{Status: TaskRunning}, nil
+	case task.fail:
+		return &StatusResult{Status: TaskFailed, Message: "Simulated failure on local provider."}, nil
+	}
+	return &StatusResult{
+		Status:         TaskSucceeded,
+		VideoURL:       p.videoURL,
+		VideoExpiresAt: task.submittedAt.Add(p.delay + localVideoURLTTL),
+		Usage:          Usage{Duration: task.duration, VideoCount: 1},
+		OrigPrompt:     task.origPrompt,
+		ActualPrompt:   task.actualPrompt,
+	}, nil
+}
+
+// Cancel 取消模拟任务，与DashScope一样只能取消排队中的任务
+func (p *localProvider) Cancel(ctx context.Context, taskID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	task, ok := p.tasks[taskID]
+	if !ok {
+		return fmt.Errorf("%w: local task %s", ErrTaskNotFound, taskID)
+	}
+	if task.canceled || time.Since(task.submittedAt) >= p.delay/2 {
+		return &Error{Code: "UnsupportedOperation", Message: "Only pending tasks can be canceled"}
+	}
+	task.canceled = true
+	return nil
+}
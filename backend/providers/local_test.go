@@ -0,0 +1,108 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestLocalProvider 创建不依赖ffmpeg和样例视频服务的本地模拟服务
+func newTestLocalProvider(delay time.Duration, failureRate float64) *localProvider {
+	return &localProvider{
+		delay:       delay,
+		failureRate: failureRate,
+		videoURL:    "http://127.0.0.1/sample.mp4",
+		tasks:       make(map[string]*localTask),
+	}
+}
+
+// backdate 将模拟任务的提交时间提前，模拟经过的时间
+func backdate(p *localProvider, taskID string, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tasks[taskID].submittedAt = time.Now().Add(-elapsed)
+}
+
+func TestLocalProviderLifecycle(t *testing.T) {
+	ctx := context.Background()
+	p := newTestLocalProvider(time.Minute, 0)
+
+	submitted, err := p.Submit(ctx, SubmitRequest{Prompt: "一只猫。", PromptExtend: true})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+
+	steps := []struct {
+		elapsed time.Duration
+		want    string
+	}{
+		{elapsed: 0, want: TaskPending},
+		{elapsed: 40 * time.Second, want: TaskRunning},
+		{elapsed: 2 * time.Minute, want: TaskSucceeded},
+	}
+	for _, step := range steps {
+		backdate(p, submitted.TaskID, step.elapsed)
+		status, err := p.Status(ctx, submitted.TaskID)
+		if err != nil {
+			t.Fatalf("Status() after %v error = %v", step.elapsed, err)
+		}
+		if status.Status != step.want {
+			t.Fatalf("Status() after %v = %s, want %s", step.elapsed, status.Status, step.want)
+		}
+		if step.want == TaskSucceeded {
+			if status.VideoURL != p.videoURL || status.Usage.Duration != localDefaultDuration {
+				t.Errorf("succeeded status = %+v", status)
+			}
+			if status.OrigPrompt != "一只猫。" || status.ActualPrompt != "一只猫"+localPromptSuffix {
+				t.Errorf("prompts = %q, %q", status.OrigPrompt, status.ActualPrompt)
+			}
+		}
+	}
+
+	if _, err := p.Status(ctx, "local-unknown"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Status() of an unknown task error = %v, want ErrTaskNotFound", err)
+	}
+}
+
+func TestLocalProviderFailureRate(t *testing.T) {
+	ctx := context.Background()
+	p := newTestLocalProvider(0, 1)
+
+	submitted, err := p.Submit(ctx, SubmitRequest{Prompt: "一只猫", Duration: 10})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	status, err := p.Status(ctx, submitted.TaskID)
+	if err != nil {
+		t.Fatalf("Status() error = %v", err)
+	}
+	if status.Status != TaskFailed || status.Message == "" {
+		t.Errorf("Status() = %+v, want FAILED with a message", status)
+	}
+}
+
+func TestLocalProviderCancel(t *testing.T) {
+	ctx := context.Background()
+	p := newTestLocalProvider(time.Minute, 0)
+
+	pending, _ := p.Submit(ctx, SubmitRequest{Prompt: "pending"})
+	if err := p.Cancel(ctx, pending.TaskID); err != nil {
+		t.Fatalf("Cancel() of a pending task error = %v", err)
+	}
+	if status, _ := p.Status(ctx, pending.TaskID); status.Status != TaskCanceled {
+		t.Errorf("Status() after Cancel() = %s, want %s", status.Status, TaskCanceled)
+	}
+
+	// 与DashScope一样，开始生成后不能取消
+	running, _ := p.Submit(ctx, SubmitRequest{Prompt: "running"})
+	backdate(p, running.TaskID, 40*time.Second)
+	var upstreamErr *Error
+	if err := p.Cancel(ctx, running.TaskID); !errors.As(err, &upstreamErr) || upstreamErr.Code != "UnsupportedOperation" {
+		t.Errorf("Cancel() of a running task error = %v, want UnsupportedOperation", err)
+	}
+
+	if _, err := p.Submit(ctx, SubmitRequest{Prompt: "image", ImagePath: "/nonexistent/input.jpg"}); err == nil {
+		t.Error("Submit() with a missing input image error = nil, want error")
+	}
+}
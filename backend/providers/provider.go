@@ -0,0 +1,121 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"emoji-maker-backend/config"
+)
+
+// 上游任务状态，各视频生成服务的状态都映射到这几种
+const (
+	TaskPending   = "PENDING"   // 排队中
+	TaskRunning   = "RUNNING"   // 生成中
+	TaskSucceeded = "SUCCEEDED" // 已生成，VideoURL可以下载
+	TaskFailed    = "FAILED"    // 生成失败
+	TaskCanceled  = "CANCELED"  // 已在上游取消
+)
+
+// VideoProvider 视频生成服务接口，任务的提交、查询和取消都通过该接口完成，
+// 新增服务只需实现该接口并在NewVideoProvider中按配置选用，不需要修改请求处理器和后台服务
+type VideoProvider interface {
+	// Name 服务名称，用于日志和状态转换记录
+	Name() string
+	// Submit 以异步方式提交生成任务，返回上游任务ID
+	Submit(ctx context.Context, req SubmitRequest) (*SubmitResult, error)
+	// Status 查询上游任务的最新状态
+	Status(ctx context.Context, taskID string) (*StatusResult, error)
+	// Cancel 请求上游取消任务
+	Cancel(ctx context.Context, taskID string) error
+}
+
+// NewVideoProvider 根据配置创建视频生成服务实例
+func NewVideoProvider() (VideoProvider, error) {
+	switch config.AppConfig.Provider.Name {
+	case "dashscope":
+		client := NewUpstreamClient("DashScope", upstreamOptions(config.AppConfig.Upstream.Timeout))
+		return NewDashScopeProvider(config.AppConfig.AI.Key, client), nil
+	case "local":
+		local := config.AppConfig.Provider.Local
+		return NewLocalProvider(local.Delay, local.FailureRate)
+	default:
+		return nil, fmt.Errorf("unknown video provider: %s", config.AppConfig.Provider.Name)
+	}
+}
+
+// NewChatClient 根据配置创建文本模型客户端实例
+func NewChatClient() ChatClient {
+	client := NewUpstreamClient("文本模型", upstreamOptions(config.AppConfig.Chat.Timeout))
+	return NewOpenAIChatClient(config.AppConfig.Chat.BaseURL, config.AppConfig.AI.Key, client)
+}
+
+// upstreamOptions 根据配置构造上游调用参数，超时时间由各上游单独配置
+func upstreamOptions(timeout time.Duration) UpstreamOptions {
+	upstream := config.AppConfig.Upstream
+	return UpstreamOptions{
+		Timeout:          timeout,
+		MaxAttempts:      upstream.MaxAttempts,
+		InitialBackoff:   upstream.InitialBackoff,
+		MaxBackoff:       upstream.MaxBackoff,
+		BreakerThreshold: upstream.BreakerThreshold,
+		BreakerCooldown:  upstream.BreakerCooldown,
+	}
+}
+
+// SubmitRequest 提交生成任务的参数
+type SubmitRequest struct {
+	Model          string
+	Prompt         string
+	NegativePrompt string
+	ImagePath      string // 图生视频输入图片在本地的路径
+	ImgURL         string // 旧版本任务保存的图片地址或Base64数据，ImagePath为空时使用
+	Size           string // 文生视频的分辨率，格式为 宽*高
+	Resolution     string // 图生视频的分辨率档位
+	Duration       int    // 视频时长(秒)，0表示使用服务的默认时长
+	Seed           int    // 随机种子
+	PromptExtend   bool   // 是否由模型扩写提示词
+	Watermark      bool   // 是否添加水印
+}
+
+// SubmitResult 提交成功的结果
+type SubmitResult struct {
+	TaskID string
+}
+
+// StatusResult 上游任务的状态
+type StatusResult struct {
+	Status         string    // 取值为上面的任务状态常量
+	VideoURL       string    // 状态为SUCCEEDED时的视频地址
+	VideoExpiresAt time.Time // 视频地址的过期时间
+	Usage          Usage     // 状态为SUCCEEDED时的计费用量
+	OrigPrompt     string    // 上游记录的原始提示词
+	ActualPrompt   string    // 开启提示词扩写时上游实际使用的提示词
+	Message        string    // 状态为FAILED或CANCELED时的原因
+}
+
+// Usage 上游生成视频的计费用量
+type Usage struct {
+	Duration   int    // 单个视频的时长(秒)
+	VideoCount int    // 生成的视频数
+	SR         int    // 清晰度档位，例如480、720
+	VideoRatio string // 宽高比或分辨率
+}
+
+// ErrTaskNotFound 上游任务不存在或已过期，继续查询也不会有结果，需要重新提交
+var ErrTaskNotFound = errors.New("upstream task not found or expired")
+
+// Error 上游服务拒绝请求时返回的错误，网络错误等其他错误原样返回
+type Error struct {
+	StatusCode int // 上游响应的HTTP状态码，未经过HTTP的错误为0
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return e.Code + ": " + e.Message
+}
@@ -0,0 +1,282 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen 上游服务连续失败后熔断期间直接返回的错误
+var ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// RetryAfterError 上游以429或503拒绝请求，并要求等待超过MaxBackoff的时间后再试时返回，请求没有被受理
+// 不在客户端内等待，避免长时间占用调用方，由调用方决定何时重新调用
+type RetryAfterError struct {
+	Name string        // 上游服务名称
+	Wait time.Duration // 上游要求的等待时间
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s is busy, retry after %s", e.Name, e.Wait.Round(time.Second))
+}
+
+// UpstreamOptions 上游调用的超时、重试和熔断参数
+type UpstreamOptions struct {
+	Timeout          time.Duration // 单次调用的超时时间，包含读取响应体的时间
+	MaxAttempts      int           // 最多调用次数(含首次)
+	InitialBackoff   time.Duration // 首次重试前的最长等待时间，之后每次翻倍，实际等待时间在其中随机
+	MaxBackoff       time.Duration // 单次等待时间的上限，Retry-After超过该时间时不等待，返回*RetryAfterError
+	BreakerThreshold int           // 连续失败多少次后熔断，0表示不熔断
+	BreakerCooldown  time.Duration // 熔断持续时间，之后放行一次试探调用
+}
+
+// UpstreamClient 调用上游AI服务共用的HTTP客户端，视频生成服务和文本模型各自使用一个实例，熔断状态互不影响
+type UpstreamClient interface {
+	// Do 发送请求，遇到网络错误、超时、429和5xx时按退避策略重试，熔断期间直接返回ErrCircuitOpen，
+	// 上游要求的等待时间超过MaxBackoff时不再重试，返回*RetryAfterError，
+	// 重试时通过GetBody重新读取请求体，最后一次调用的响应原样返回给调用方。
+	// 非幂等的请求(例如提交任务的POST)可能已被上游受理，只在连接未建立或上游返回429、503时重试，
+	// 与net/http的约定相同，设置了Idempotency-Key头(值可以为nil，此时不发送)的请求视为幂等
+	Do(request *http.Request) (*http.Response, error)
+}
+
+// upstreamClientImpl 带超时、重试和熔断的上游客户端实现
+type upstreamClientImpl struct {
+	name    string
+	options UpstreamOptions
+	client  *http.Client
+	breaker *circuitBreaker
+}
+
+// NewUpstreamClient 创建上游客户端实例，name为上游服务名称，用于日志和错误信息
+func NewUpstreamClient(name string, options UpstreamOptions) UpstreamClient {
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = 1
+	}
+	return &upstreamClientImpl{
+		name:    name,
+		options: options,
+		client:  &http.Client{},
+		breaker: &circuitBreaker{threshold: options.BreakerThreshold, cooldown: options.BreakerCooldown},
+	}
+}
+
+// Do 发送请求并在可重试的错误上重试
+func (c *upstreamClientImpl) Do(request *http.Request) (*http.Response, error) {
+	if wait, ok := c.breaker.allow(); !ok {
+		return nil, fmt.Errorf("%w: %s is unavailable after repeated failures, retry in %s", ErrCircuitOpen, c.name, wait.Round(time.Second))
+	}
+
+	ctx := request.Context()
+	for attempt := 1; ; attempt++ {
+		response, err := c.send(request)
+		retryAfter, retryable := shouldRetry(ctx, request, response, err)
+		if !retryable || attempt >= c.options.MaxAttempts || (request.Body != nil && request.GetBody == nil) {
+			c.record(ctx, response, err)
+			return response, err
+		}
+		if retryAfter > c.options.MaxBackoff {
+			c.record(ctx, response, err)
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+			return nil, &RetryAfterError{Name: c.name, Wait: retryAfter}
+		}
+
+		wait := c.backoff(attempt, retryAfter)
+		if err != nil {
+			log.Printf("调用%s失败，%s后进行第%d次重试: %v", c.name, wait, attempt+1, err)
+		} else {
+			log.Printf("调用%s返回 %s，%s后进行第%d次重试", c.name, response.Status, wait, attempt+1)
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.breaker.release()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				c.breaker.release()
+				return nil, err
+			}
+			request.Body = body
+		}
+	}
+}
+
+// send 以单次调用的超时时间发送请求，超时覆盖到响应体关闭为止
+func (c *upstreamClientImpl) send(request *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(request.Context(), c.options.Timeout)
+	response, err := c.client.Do(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// record 根据最终结果更新熔断状态，调用方主动取消不计入
+func (c *upstreamClientImpl) record(ctx context.Context, response *http.Response, err error) {
+	switch {
+	case ctx.Err() != nil:
+		c.breaker.release()
+	case err != nil || response.StatusCode >= http.StatusInternalServerError:
+		if c.breaker.failure() {
+			log.Printf("%s连续调用失败，熔断 %s", c.name, c.options.BreakerCooldown)
+		}
+	default:
+		c.breaker.success()
+	}
+}
+
+// backoff 计算第attempt次调用失败后的等待时间，上游给出Retry-After时以其为准，否则使用带随机抖动的指数退避
+func (c *upstreamClientImpl) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	ceiling := c.options.InitialBackoff << (attempt - 1)
+	if ceiling <= 0 || ceiling > c.options.MaxBackoff {
+		ceiling = c.options.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling) + 1
+}
+
+// shouldRetry 判断调用结果是否可以重试，返回上游要求的等待时间
+func shouldRetry(ctx context.Context, request *http.Request, response *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		// 调用方取消或整体超时时不再重试；非幂等的请求在连接建立后出错(包括单次调用超时)时上游可能已经受理
+		return 0, ctx.Err() == nil && (isIdempotent(request) || isDialError(err))
+	}
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// 上游明确拒绝了请求，没有受理
+		return parseRetryAfter(response.Header.Get("Retry-After")), true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return 0, isIdempotent(request)
+	}
+	return 0, false
+}
+
+// isIdempotent 判断请求是否可以安全地重复发送
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	if _, ok := request.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := request.Header["X-Idempotency-Key"]
+	return ok
+}
+
+// isDialError 判断错误是否发生在建立连接时，此时请求一定没有发送到上游
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// parseRetryAfter 解析Retry-After头，支持秒数和HTTP日期两种格式，无法解析时返回0
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// cancelOnClose 响应体关闭时释放单次调用的超时上下文
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// circuitBreaker 连续失败计数熔断器
+// 连续失败达到阈值后在冷却时间内拒绝所有调用，冷却结束后只放行一次试探调用，成功则恢复，失败则重新熔断
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool // 冷却结束后的试探调用是否正在进行
+}
+
+// allow 判断是否放行调用，拒绝时返回预计需要等待的时间
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return 0, true
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait, false
+	}
+	if b.probing {
+		return b.cooldown, false
+	}
+	b.probing = true
+	return 0, true
+}
+
+// success 记录一次成功的调用，恢复为正常状态
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+// failure 记录一次失败的调用，返回是否因此进入熔断
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(b.cooldown)
+	return true
+}
+
+// release 调用被调用方取消，不计入结果，只结束试探状态
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,289 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRequestBody = `{"model":"test"}`
+
+// testUpstreamOptions 测试用的参数，退避时间很短
+func testUpstreamOptions() UpstreamOptions {
+	return UpstreamOptions{
+		Timeout:        200 * time.Millisecond,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	}
+}
+
+// countingServer 返回记录调用次数的测试服务器
+func countingServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+// newTestRequest 创建测试请求，POST请求带有可重复读取的请求体
+func newTestRequest(t *testing.T, method, url string) *http.Request {
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(testRequestBody)
+	}
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestUpstreamClientRetriesByMethod(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		idempotent bool
+		status     int
+		wantCalls  int32
+	}{
+		{name: "GET 500", method: http.MethodGet, status: http.StatusInternalServerError, wantCalls: 3},
+		{name: "GET 502", method: http.MethodGet, status: http.StatusBadGateway, wantCalls: 3},
+		{name: "GET 400", method: http.MethodGet, status: http.StatusBadRequest, wantCalls: 1},
+		{name: "POST 500", method: http.MethodPost, status: http.StatusInternalServerError, wantCalls: 1},
+		{name: "POST 504", method: http.MethodPost, status: http.StatusGatewayTimeout, wantCalls: 1},
+		{name: "POST 429", method: http.MethodPost, status: http.StatusTooManyRequests, wantCalls: 3},
+		{name: "POST 503", method: http.MethodPost, status: http.StatusServiceUnavailable, wantCalls: 3},
+		{name: "idempotent POST 500", method: http.MethodPost, idempotent: true, status: http.StatusInternalServerError, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					if body, _ := io.ReadAll(r.Body); string(body) != testRequestBody {
+						t.Errorf("request body = %q, want the original body on every attempt", body)
+					}
+				}
+				if _, ok := r.Header["Idempotency-Key"]; ok {
+					t.Error("nil Idempotency-Key header must not be sent")
+				}
+				w.WriteHeader(tt.status)
+			})
+
+			client := NewUpstreamClient("test", testUpstreamOptions())
+			request := newTestRequest(t, tt.method, server.URL)
+			if tt.idempotent {
+				request.Header["Idempotency-Key"] = nil
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			response.Body.Close()
+			if response.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", response.StatusCode, tt.status)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestUpstreamClientDoesNotRetryPostAfterTimeout(t *testing.T) {
+	// 上游受理了请求但响应很慢，重新提交会产生重复的计费任务
+	server, calls := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	client := NewUpstreamClient("test", testUpstreamOptions())
+	_, err := client.Do(newTestRequest(t, http.MethodPost, server.URL))
+	if err == nil {
+		t.Fatal("Do() error = nil, want timeout")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("calls = %d, want 1", got)
+	}
+}
+
+func TestUpstreamClientRetriesGetAfterTimeout(t *testing.T) {
+	server, calls := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	client := NewUpstreamClient("test", testUpstreamOptions())
+	if _, err := client.Do(newTestRequest(t, http.MethodGet, server.URL)); err == nil {
+		t.Fatal("Do() error = nil, want timeout")
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("calls = %d, want 3", got)
+	}
+}
+
+func TestShouldRetryDialError(t *testing.T) {
+	// 关闭的端口上连接失败，请求一定没有到达上游
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+	listener.Close()
+
+	request := newTestRequest(t, http.MethodPost, url)
+	_, err = http.DefaultClient.Do(request)
+	if err == nil {
+		t.Fatal("expected a dial error")
+	}
+	if _, retryable := shouldRetry(context.Background(), request, nil, err); !retryable {
+		t.Errorf("shouldRetry(POST, %v) = false, want true", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, retryable := shouldRetry(ctx, request, nil, err); retryable {
+		t.Error("shouldRetry() = true after the caller canceled, want false")
+	}
+}
+
+func TestUpstreamClientCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	server, calls := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	options := testUpstreamOptions()
+	options.MaxAttempts = 1
+	options.BreakerThreshold = 2
+	options.BreakerCooldown = 100 * time.Millisecond
+	client := NewUpstreamClient("test", options)
+	get := func() error {
+		response, err := client.Do(newTestRequest(t, http.MethodGet, server.URL))
+		if err == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatalf("call %d error = %v", i+1, err)
+		}
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("error after %d failures = %v, want ErrCircuitOpen", options.BreakerThreshold, err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("calls = %d, want 2 (open breaker must not call upstream)", got)
+	}
+
+	// 冷却结束后放行一次试探调用，成功后恢复
+	time.Sleep(options.BreakerCooldown)
+	failing.Store(false)
+	if err := get(); err != nil {
+		t.Fatalf("probe error = %v", err)
+	}
+	if err := get(); err != nil {
+		t.Fatalf("call after recovery error = %v", err)
+	}
+	if got := calls.Load(); got != 4 {
+		t.Errorf("calls = %d, want 4", got)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 1, cooldown: 10 * time.Millisecond}
+	breaker.failure()
+	if _, ok := breaker.allow(); ok {
+		t.Fatal("allow() = true while open")
+	}
+
+	time.Sleep(breaker.cooldown)
+	if _, ok := breaker.allow(); !ok {
+		t.Fatal("allow() = false after cooldown, want a probe")
+	}
+	if _, ok := breaker.allow(); ok {
+		t.Fatal("allow() = true while the probe is in flight")
+	}
+
+	// 试探失败重新熔断
+	if !breaker.failure() {
+		t.Error("failure() after a failed probe = false, want reopened")
+	}
+	if _, ok := breaker.allow(); ok {
+		t.Error("allow() = true after a failed probe")
+	}
+}
+
+func TestUpstreamClientRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		wantCalls  int32
+		wantWait   time.Duration // 不为0时期望返回*RetryAfterError
+	}{
+		{name: "within max backoff", retryAfter: "1", wantCalls: 2},
+		{name: "beyond max backoff", retryAfter: "3600", wantCalls: 1, wantWait: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", tt.retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+			})
+			options := testUpstreamOptions()
+			options.MaxAttempts = 2
+			options.MaxBackoff = 2 * time.Second
+			client := NewUpstreamClient("test", options)
+
+			start := time.Now()
+			response, err := client.Do(newTestRequest(t, http.MethodPost, server.URL))
+			if response != nil {
+				response.Body.Close()
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+
+			var retryAfter *RetryAfterError
+			if tt.wantWait == 0 {
+				if err != nil || response.StatusCode != http.StatusTooManyRequests {
+					t.Errorf("Do() = %v, %v, want the last 429 response", response, err)
+				}
+				return
+			}
+			if !errors.As(err, &retryAfter) || retryAfter.Wait != tt.wantWait {
+				t.Fatalf("Do() error = %v, want *RetryAfterError with wait %s", err, tt.wantWait)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Do() waited %s before returning", elapsed)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("3"); got != 3*time.Second {
+		t.Errorf(`parseRetryAfter("3") = %s, want 3s`, got)
+	}
+	if got := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); got <= 59*time.Minute {
+		t.Errorf("parseRetryAfter(date) = %s, want about 1h", got)
+	}
+	for _, value := range []string{"", "-1", "soon"} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %s, want 0", value, got)
+		}
+	}
+}
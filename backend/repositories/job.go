@@ -0,0 +1,278 @@
+package repositories
+
+import (
+	"fmt"
+	"time"
+
+	"emoji-maker-backend/models"
+
+	"xorm.io/xorm"
+)
+
+// JobListFilter 任务列表查询条件
+type JobListFilter struct {
+	Status   string // 按状态过滤，为空时不过滤
+	Type     string // 按任务类型过滤，为空时不过滤
+	BeforeID int64  // 游标，只返回ID小于该值的任务，为0时从最新的任务开始
+	Limit    int
+}
+
+// JobRepository 视频任务仓库接口
+type JobRepository interface {
+	Create(job *models.Job) error
+	FindByJobIDForUser(jobID string, userID int64) (*models.Job, error)
+	FindByIdempotencyKey(userID int64, key string, since time.Time) (*models.Job, error)
+	FindTransitions(jobID string) ([]*models.JobTransition, error)
+	UpdateIfActive(job *models.Job) (bool, error)
+	UpdateIfStatus(job *models.Job, statuses ...string) (bool, error)
+	FindActive() ([]*models.Job, error)
+	FindUnfinished() ([]*models.Job, error)
+	ListByUser(userID int64, filter JobListFilter) ([]*models.Job, error)
+	FindByBatchID(batchID string) ([]*models.Job, error)
+	Delete(job *models.Job) error
+	FindFinishedBefore(before time.Time, limit int) ([]*models.Job, error)
+	FindUserIDsOverLimit(limit int) ([]int64, error)
+	FindFinishedByUserBeyond(userID int64, keep int) ([]*models.Job, error)
+	FindFinishedWithOutput(limit int) ([]*models.Job, error)
+	ExistsByOutputPath(path string) (bool, error)
+	ExistsByInputImagePath(path string) (bool, error)
+}
+
+// xormJobRepository 视频任务仓库实现
+type xormJobRepository struct {
+	engine *xorm.Engine
+}
+
+// NewXormJobRepository 创建视频任务仓库实例
+func NewXormJobRepository(engine *xorm.Engine) JobRepository {
+	return &xormJobRepository{engine: engine}
+}
+
+// Create 创建任务，并记录任务的初始状态
+func (r *xormJobRepository) Create(job *models.Job) error {
+	_, err := r.engine.Transaction(func(session *xorm.Session) (interface{}, error) {
+		if _, err := session.Insert(job); err != nil {
+			return nil, err
+		}
+		return session.Insert(&models.JobTransition{
+			JobID:  job.JobID,
+			To:     job.Status,
+			Step:   models.JobStepCreate,
+			Reason: "任务创建",
+			At:     time.Now(),
+		})
+	})
+	return err
+}
+
+// FindByJobIDForUser 根据任务ID查找属于指定用户的任务，不属于该用户时视为不存在
+func (r *xormJobRepository) FindByJobIDForUser(jobID string, userID int64) (*models.Job, error) {
+	var job models.Job
+	has, err := r.engine.Where("job_id = ? AND user_id = ?", jobID, userID).Get(&job)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, nil // 任务不存在或不属于该用户
+	}
+	return &job, nil
+}
+
+// FindByIdempotencyKey 查找用户在指定时间之后使用该幂等键创建的最新任务
+func (r *xormJobRepository) FindByIdempotencyKey(userID int64, key string, since time.Time) (*models.Job, error) {
+	var job models.Job
+	has, err := r.engine.
+		Where("user_id = ? AND idempotency_key = ?", userID, key).
+		And("created_at >= ?", since).
+		Desc("id").
+		Get(&job)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, nil // 窗口期内没有使用该幂等键的任务
+	}
+	return &job, nil
+}
+
+// UpdateIfActive 仅当数据库中的任务尚未进入终态时才更新，返回是否更新成功
+// 用于后台流程写入，避免覆盖已被取消的任务
+func (r *xormJobRepository) UpdateIfActive(job *models.Job) (bool, error) {
+	return r.UpdateIfStatus(job, models.ActiveStatuses...)
+}
+
+// UpdateIfStatus 仅当数据库中的任务处于给定状态之一，且该状态可以按状态机转换到新状态时才更新，返回是否更新成功
+// 更新同时校验版本号，任务读出后已被其他流程修改过时不会覆盖对方的修改
+func (r *xormJobRepository) UpdateIfStatus(job *models.Job, statuses ...string) (bool, error) {
+	var allowed []string
+	for _, status := range statuses {
+		if models.CanTransition(status, job.Status) {
+			allowed = append(allowed, status)
+		}
+	}
+	if len(allowed) == 0 {
+		job.TakeTransitions()
+		return false, nil
+	}
+	return r.update(job, allowed)
+}
+
+// update 在同一事务中更新任务并写入尚未保存的状态转换记录，未更新时丢弃转换记录
+// xorm会根据version字段自动附加版本号条件并在成功后递增
+func (r *xormJobRepository) update(job *models.Job, statuses []string) (bool, error) {
+	transitions := job.TakeTransitions()
+	updated, err := r.engine.Transaction(func(session *xorm.Session) (interface{}, error) {
+		// 使用AllCols以便清空错误信息等零值字段
+		affected, err := session.ID(job.ID).
+			In("status", statuses).
+			AllCols().
+			Update(job)
+		if err != nil || affected == 0 {
+			return false, err
+		}
+		for i := range transitions {
+			if _, err := session.Insert(&transitions[i]); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return updated.(bool), nil
+}
+
+// FindTransitions 按发生顺序查询任务的状态转换记录
+func (r *xormJobRepository) FindTransitions(jobID string) ([]*models.JobTransition, error) {
+	var transitions []*models.JobTransition
+	err := r.engine.Where("job_id = ?", jobID).Asc("id").Find(&transitions)
+	return transitions, err
+}
+
+// FindActive 查找已提交到视频生成服务但尚未完成的任务
+func (r *xormJobRepository) FindActive() ([]*models.Job, error) {
+	var jobs []*models.Job
+	err := r.engine.
+		In("status", models.ActiveStatuses).
+		And("dashscope_task_id <> ''").
+		Asc("id").
+		Find(&jobs)
+	return jobs, err
+}
+
+// FindUnfinished 查找所有未结束的任务，包括尚未提交的任务
+func (r *xormJobRepository) FindUnfinished() ([]*models.Job, error) {
+	var jobs []*models.Job
+	err := r.engine.
+		In("status", models.ActiveStatuses).
+		Asc("id").
+		Find(&jobs)
+	return jobs, err
+}
+
+// ListByUser 按创建时间倒序分页查询用户的任务
+func (r *xormJobRepository) ListByUser(userID int64, filter JobListFilter) ([]*models.Job, error) {
+	session := r.engine.Where("user_id = ?", userID)
+	if filter.Status != "" {
+		session = session.And("status = ?", filter.Status)
+	}
+	if filter.Type != "" {
+		session = session.And("type = ?", filter.Type)
+	}
+	if filter.BeforeID > 0 {
+		session = session.And("id < ?", filter.BeforeID)
+	}
+
+	var jobs []*models.Job
+	err := session.Desc("id").Limit(filter.Limit).Find(&jobs)
+	return jobs, err
+}
+
+// FindByBatchID 按创建顺序查找批次中的所有任务
+func (r *xormJobRepository) FindByBatchID(batchID string) ([]*models.Job, error) {
+	var jobs []*models.Job
+	err := r.engine.Where("batch_id = ?", batchID).Asc("id").Find(&jobs)
+	return jobs, err
+}
+
+// Delete 删除任务记录及其状态转换记录和回调投递记录，任务是批次中最后一个任务时一并删除批次
+func (r *xormJobRepository) Delete(job *models.Job) error {
+	_, err := r.engine.Transaction(func(session *xorm.Session) (interface{}, error) {
+		if _, err := session.Where("job_id = ?", job.JobID).Delete(&models.JobTransition{}); err != nil {
+			return nil, err
+		}
+		if _, err := session.Where("job_id = ?", job.JobID).Delete(&models.WebhookDelivery{}); err != nil {
+			return nil, err
+		}
+		if _, err := session.ID(job.ID).Delete(&models.Job{}); err != nil {
+			return nil, err
+		}
+		if job.BatchID == "" {
+			return nil, nil
+		}
+		remaining, err := session.Where("batch_id = ?", job.BatchID).Exist(&models.Job{})
+		if err != nil || remaining {
+			return nil, err
+		}
+		return session.Where("batch_id = ?", job.BatchID).Delete(&models.JobBatch{})
+	})
+	return err
+}
+
+// FindFinishedBefore 查找在指定时间之前创建且已结束的任务，最旧的在前
+func (r *xormJobRepository) FindFinishedBefore(before time.Time, limit int) ([]*models.Job, error) {
+	var jobs []*models.Job
+	err := r.engine.
+		In("status", models.TerminalStatuses).
+		And("created_at < ?", before).
+		Asc("id").
+		Limit(limit).
+		Find(&jobs)
+	return jobs, err
+}
+
+// FindUserIDsOverLimit 查找任务数超过上限的用户
+func (r *xormJobRepository) FindUserIDsOverLimit(limit int) ([]int64, error) {
+	var userIDs []int64
+	err := r.engine.Table(new(models.Job)).
+		Cols("user_id").
+		GroupBy("user_id").
+		Having(fmt.Sprintf("COUNT(*) > %d", limit)).
+		Find(&userIDs)
+	return userIDs, err
+}
+
+// FindFinishedByUserBeyond 查找用户最新的keep个任务之外的已结束任务
+func (r *xormJobRepository) FindFinishedByUserBeyond(userID int64, keep int) ([]*models.Job, error) {
+	var jobs []*models.Job
+	err := r.engine.
+		Where("user_id = ?", userID).
+		In("status", models.TerminalStatuses).
+		Desc("id").
+		Limit(-1, keep).
+		Find(&jobs)
+	return jobs, err
+}
+
+// FindFinishedWithOutput 查找已生成GIF的已结束任务，最旧的在前
+func (r *xormJobRepository) FindFinishedWithOutput(limit int) ([]*models.Job, error) {
+	var jobs []*models.Job
+	err := r.engine.
+		In("status", models.TerminalStatuses).
+		And("output_path <> ''").
+		Asc("id").
+		Limit(limit).
+		Find(&jobs)
+	return jobs, err
+}
+
+// ExistsByOutputPath 是否有任务引用了该GIF文件
+func (r *xormJobRepository) ExistsByOutputPath(path string) (bool, error) {
+	return r.engine.Where("output_path = ?", path).Exist(&models.Job{})
+}
+
+// ExistsByInputImagePath 是否有任务引用了该输入图片
+func (r *xormJobRepository) ExistsByInputImagePath(path string) (bool, error) {
+	return r.engine.Where("input_image_path = ?", path).Exist(&models.Job{})
+}
@@ -0,0 +1,49 @@
+package repositories
+
+import (
+	"emoji-maker-backend/models"
+
+	"xorm.io/xorm"
+)
+
+// JobBatchRepository 批量任务仓库接口
+type JobBatchRepository interface {
+	Create(batch *models.JobBatch) error
+	FindByBatchIDForUser(batchID string, userID int64) (*models.JobBatch, error)
+	Delete(batchID string) error
+}
+
+// xormJobBatchRepository 批量任务仓库实现
+type xormJobBatchRepository struct {
+	engine *xorm.Engine
+}
+
+// NewXormJobBatchRepository 创建批量任务仓库实例
+func NewXormJobBatchRepository(engine *xorm.Engine) JobBatchRepository {
+	return &xormJobBatchRepository{engine: engine}
+}
+
+// Create 创建批次
+func (r *xormJobBatchRepository) Create(batch *models.JobBatch) error {
+	_, err := r.engine.Insert(batch)
+	return err
+}
+
+// FindByBatchIDForUser 根据批次ID查找属于指定用户的批次，不属于该用户时视为不存在
+func (r *xormJobBatchRepository) FindByBatchIDForUser(batchID string, userID int64) (*models.JobBatch, error) {
+	var batch models.JobBatch
+	has, err := r.engine.Where("batch_id = ? AND user_id = ?", batchID, userID).Get(&batch)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, nil // 批次不存在或不属于该用户
+	}
+	return &batch, nil
+}
+
+// Delete 删除批次记录，批次中的任务由调用方处理
+func (r *xormJobBatchRepository) Delete(batchID string) error {
+	_, err := r.engine.Where("batch_id = ?", batchID).Delete(&models.JobBatch{})
+	return err
+}
@@ -0,0 +1,91 @@
+package repositories
+
+import (
+	"time"
+
+	"emoji-maker-backend/models"
+
+	"xorm.io/xorm"
+)
+
+// UsageTotal 一组用量记录的汇总
+type UsageTotal struct {
+	UserID       int64   `xorm:"user_id" json:"user_id,omitempty"`
+	Day          string  `xorm:"day" json:"day,omitempty"` // 按天汇总时的日期，格式为 2006-01-02
+	Jobs         int64   `xorm:"jobs" json:"jobs"`         // 产生用量的任务数
+	VideoSeconds int64   `xorm:"video_seconds" json:"video_seconds"`
+	VideoCount   int64   `xorm:"video_count" json:"video_count"`
+	TextTokens   int64   `xorm:"text_tokens" json:"text_tokens"`
+	Cost         float64 `xorm:"cost" json:"cost"`
+}
+
+// usageTotalColumns 汇总查询的公共列
+const usageTotalColumns = "COUNT(DISTINCT job_id) AS jobs, SUM(video_seconds) AS video_seconds, SUM(video_count) AS video_count, SUM(text_tokens) AS text_tokens, SUM(cost) AS cost"
+
+// UsageRepository 用量记录仓库接口
+type UsageRepository interface {
+	Create(record *models.UsageRecord) error
+	// Total 汇总时间范围内的用量，userID为0时汇总所有用户
+	Total(userID int64, from, to time.Time) (*UsageTotal, error)
+	// TotalByUser 汇总时间范围内每个用户的用量，费用最高的在前
+	TotalByUser(from, to time.Time) ([]*UsageTotal, error)
+	// TotalByDay 按天汇总时间范围内的用量，userID为0时汇总所有用户
+	TotalByDay(userID int64, from, to time.Time) ([]*UsageTotal, error)
+}
+
+// xormUsageRepository 用量记录仓库实现
+type xormUsageRepository struct {
+	engine *xorm.Engine
+}
+
+// NewXormUsageRepository 创建用量记录仓库实例
+func NewXormUsageRepository(engine *xorm.Engine) UsageRepository {
+	return &xormUsageRepository{engine: engine}
+}
+
+// Create 保存用量记录
+func (r *xormUsageRepository) Create(record *models.UsageRecord) error {
+	_, err := r.engine.Insert(record)
+	return err
+}
+
+// Total 汇总用量
+func (r *xormUsageRepository) Total(userID int64, from, to time.Time) (*UsageTotal, error) {
+	var total UsageTotal
+	session := r.engine.Table(new(models.UsageRecord)).
+		Select(usageTotalColumns).
+		Where("created_at >= ? AND created_at < ?", from, to)
+	if userID != 0 {
+		session = session.And("user_id = ?", userID)
+	}
+	if _, err := session.Get(&total); err != nil {
+		return nil, err
+	}
+	total.UserID = userID
+	return &total, nil
+}
+
+// TotalByUser 按用户汇总用量
+func (r *xormUsageRepository) TotalByUser(from, to time.Time) ([]*UsageTotal, error) {
+	totals := make([]*UsageTotal, 0)
+	err := r.engine.Table(new(models.UsageRecord)).
+		Select("user_id, "+usageTotalColumns).
+		Where("created_at >= ? AND created_at < ?", from, to).
+		GroupBy("user_id").
+		Desc("cost").
+		Find(&totals)
+	return totals, err
+}
+
+// TotalByDay 按天汇总用量，日期按服务器时区计算
+func (r *xormUsageRepository) TotalByDay(userID int64, from, to time.Time) ([]*UsageTotal, error) {
+	totals := make([]*UsageTotal, 0)
+	session := r.engine.Table(new(models.UsageRecord)).
+		Select("date(created_at) AS day, "+usageTotalColumns).
+		Where("created_at >= ? AND created_at < ?", from, to)
+	if userID != 0 {
+		session = session.And("user_id = ?", userID)
+	}
+	err := session.GroupBy("day").Asc("day").Find(&totals)
+	return totals, err
+}
@@ -0,0 +1,36 @@
+package repositories
+
+import (
+	"emoji-maker-backend/models"
+
+	"xorm.io/xorm"
+)
+
+// WebhookDeliveryRepository 回调投递记录仓库接口
+type WebhookDeliveryRepository interface {
+	Create(delivery *models.WebhookDelivery) error
+	FindByJobID(jobID string) ([]*models.WebhookDelivery, error)
+}
+
+// xormWebhookDeliveryRepository 回调投递记录仓库实现
+type xormWebhookDeliveryRepository struct {
+	engine *xorm.Engine
+}
+
+// NewXormWebhookDeliveryRepository 创建回调投递记录仓库实例
+func NewXormWebhookDeliveryRepository(engine *xorm.Engine) WebhookDeliveryRepository {
+	return &xormWebhookDeliveryRepository{engine: engine}
+}
+
+// Create 保存一次投递记录
+func (r *xormWebhookDeliveryRepository) Create(delivery *models.WebhookDelivery) error {
+	_, err := r.engine.Insert(delivery)
+	return err
+}
+
+// FindByJobID 按投递顺序查询任务的所有投递记录
+func (r *xormWebhookDeliveryRepository) FindByJobID(jobID string) ([]*models.WebhookDelivery, error) {
+	var deliveries []*models.WebhookDelivery
+	err := r.engine.Where("job_id = ?", jobID).Asc("id").Find(&deliveries)
+	return deliveries, err
+}
@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"emoji-maker-backend/controllers"
+	"emoji-maker-backend/middleware"
+	"emoji-maker-backend/repositories"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SetupUsageRoutes 设置用量统计相关路由
+func SetupUsageRoutes(app *fiber.App, usageRepo repositories.UsageRepository) {
+	// 初始化依赖
+	usageHandler := controllers.NewUsageHandler(usageRepo)
+
+	// 查询当前用户的用量
+	app.Get("/api/v1/usage", middleware.Protected(), usageHandler.GetUserUsage)
+
+	// 管理接口，只允许配置中的管理员访问
+	admin := app.Group("/api/v1/admin", middleware.Protected(), middleware.AdminOnly())
+
+	// 按用户汇总用量
+	admin.Get("/usage/users", usageHandler.GetUsageByUser)
+
+	// 按天汇总用量
+	admin.Get("/usage/daily", usageHandler.GetUsageByDay)
+}
@@ -3,20 +3,66 @@ package routes
 import (
 	"emoji-maker-backend/controllers"
 	"emoji-maker-backend/middleware"
+	"emoji-maker-backend/providers"
+	"emoji-maker-backend/repositories"
+	"emoji-maker-backend/services"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func SetupVideoRoutes(app *fiber.App) {
+// SetupVideoRoutes 设置视频相关路由，任务仓库和共享服务由app.go创建并与后台服务共用
+func SetupVideoRoutes(app *fiber.App, jobRepo repositories.JobRepository, deliveryRepo repositories.WebhookDeliveryRepository, batchRepo repositories.JobBatchRepository, canceler services.JobCanceler, events services.JobEventBroker, scheduler services.JobScheduler, provider providers.VideoProvider, catalog services.ModelCatalog, chat providers.ChatClient, usageRepo repositories.UsageRepository) {
+	// 初始化依赖
+	videoHandler := controllers.NewVideoHandler(jobRepo, deliveryRepo, batchRepo, canceler, events, scheduler, provider, catalog, chat, usageRepo)
+
+	// SSE接口允许通过token查询参数认证，需在视频路由组的认证中间件之前注册
+	app.Use("/api/v1/video/events", middleware.QueryToken())
+
 	// 视频相关路由
 	video := app.Group("/api/v1/video", middleware.Protected())
 
+	// 查询可用的模型目录
+	video.Get("/models", videoHandler.ListModels)
+
 	// 创建视频生成任务
-	video.Post("/create", controllers.CreateVideoTask)
+	video.Post("/create", videoHandler.CreateVideoTask)
 
 	// 创建视频生成任务 (带提示词处理)
-	video.Post("/create_with_prompt", controllers.CreateVideoTaskWithPromptProcessing)
+	video.Post("/create_with_prompt", videoHandler.CreateVideoTaskWithPromptProcessing)
+
+	// 预览图生视频输入图片的预处理结果
+	video.Post("/image/preview", videoHandler.PreviewInputImage)
+
+	// 批量创建视频生成任务
+	video.Post("/batch", videoHandler.CreateVideoBatch)
+
+	// 查询批次进度
+	video.Get("/batch/:batch_id", videoHandler.GetVideoBatch)
 
 	// 查询任务结果
-	video.Get("/query/:job_id", controllers.GetVideoTaskResult)
+	video.Get("/query/:job_id", videoHandler.GetVideoTaskResult)
+
+	// 获取任务预处理后的输入图片
+	video.Get("/input/:job_id", videoHandler.GetInputImage)
+
+	// 取消进行中的任务
+	video.Post("/cancel/:job_id", videoHandler.CancelVideoTask)
+
+	// 重试失败的任务
+	video.Post("/retry/:job_id", videoHandler.RetryVideoTask)
+
+	// 查询当前用户的历史任务
+	video.Get("/jobs", videoHandler.ListVideoTasks)
+
+	// 查询任务的状态转换时间线
+	video.Get("/timeline/:job_id", videoHandler.GetVideoTaskTimeline)
+
+	// 查询任务的回调投递记录
+	video.Get("/webhooks/:job_id", videoHandler.ListWebhookDeliveries)
+
+	// 通过SSE订阅当前用户所有任务的状态变化
+	video.Get("/events", videoHandler.StreamUserTaskEvents)
+
+	// 通过SSE订阅单个任务的状态变化
+	video.Get("/events/:job_id", videoHandler.StreamVideoTaskEvents)
 }
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// EXIF方向标签
+const exifOrientationTag = 0x0112
+
+// exifOrientation 读取图片EXIF中的方向，取值1到8，没有EXIF或无法解析时返回1(不需要旋转)
+// 支持JPEG的APP1段、PNG的eXIf块和WebP的EXIF块
+func exifOrientation(data []byte, mime string) int {
+	var tiff []byte
+	switch mime {
+	case "image/jpeg":
+		tiff = jpegExif(data)
+	case "image/png":
+		tiff = pngExif(data)
+	case "image/webp":
+		tiff = webpExif(data)
+	}
+	if orientation := tiffOrientation(tiff); orientation >= 1 && orientation <= 8 {
+		return orientation
+	}
+	return 1
+}
+
+// jpegExif 从JPEG的APP1段中取出TIFF格式的EXIF数据
+func jpegExif(data []byte) []byte {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return nil
+		}
+		marker := data[pos+1]
+		if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 || marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// 之后是图像数据，EXIF只会出现在前面
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// pngExif 从PNG的eXIf块中取出EXIF数据
+func pngExif(data []byte) []byte {
+	const signatureLength = 8
+	for pos := signatureLength; pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 8 + length
+		if length < 0 || end+4 > len(data) {
+			return nil
+		}
+		switch chunkType {
+		case "eXIf":
+			return data[pos+8 : end]
+		case "IDAT", "IEND":
+			return nil
+		}
+		pos = end + 4 // 跳过CRC
+	}
+	return nil
+}
+
+// webpExif 从WebP的EXIF块中取出EXIF数据
+func webpExif(data []byte) []byte {
+	const headerLength = 12 // RIFF + 文件大小 + WEBP
+	for pos := headerLength; pos+8 <= len(data); {
+		chunkType := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + length
+		if length < 0 || end > len(data) {
+			return nil
+		}
+		if chunkType == "EXIF" {
+			// 部分编码器会保留JPEG中的Exif前缀
+			return bytes.TrimPrefix(data[pos+8:end], []byte("Exif\x00\x00"))
+		}
+		pos = end + length%2 // 块按偶数字节对齐
+	}
+	return nil
+}
+
+// tiffOrientation 在TIFF格式EXIF数据的第一个IFD中查找方向标签，找不到时返回0
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			// 类型为SHORT，值直接保存在条目的值字段中
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// applyOrientation 按EXIF方向旋转或翻转图片，使其按正确的方向显示
+func applyOrientation(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	// 按字节复制像素，避免逐像素的颜色模型转换
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		// 5到8需要旋转90度，宽高互换
+		dstW, dstH = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // 水平翻转
+				sx, sy = w-1-x, y
+			case 3: // 旋转180度
+				sx, sy = w-1-x, h-1-y
+			case 4: // 垂直翻转
+				sx, sy = x, h-1-y
+			case 5: // 沿左上到右下的对角线翻转
+				sx, sy = y, x
+			case 6: // 顺时针旋转90度
+				sx, sy = y, h-1-x
+			case 7: // 沿右上到左下的对角线翻转
+				sx, sy = w-1-y, h-1-x
+			case 8: // 逆时针旋转90度
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// unorientRect 将摆正后图片中的区域换算为原始方向图片中的区域，bounds为原始图片的范围
+func unorientRect(r image.Rectangle, orientation int, bounds image.Rectangle) image.Rectangle {
+	w, h := bounds.Dx(), bounds.Dy()
+	var raw image.Rectangle
+	switch orientation {
+	case 2:
+		raw = image.Rect(w-r.Max.X, r.Min.Y, w-r.Min.X, r.Max.Y)
+	case 3:
+		raw = image.Rect(w-r.Max.X, h-r.Max.Y, w-r.Min.X, h-r.Min.Y)
+	case 4:
+		raw = image.Rect(r.Min.X, h-r.Max.Y, r.Max.X, h-r.Min.Y)
+	case 5:
+		raw = image.Rect(r.Min.Y, r.Min.X, r.Max.Y, r.Max.X)
+	case 6:
+		raw = image.Rect(r.Min.Y, h-r.Max.X, r.Max.Y, h-r.Min.X)
+	case 7:
+		raw = image.Rect(w-r.Max.Y, h-r.Max.X, w-r.Min.Y, h-r.Min.X)
+	case 8:
+		raw = image.Rect(w-r.Max.Y, r.Min.X, w-r.Min.Y, r.Max.X)
+	default:
+		raw = r
+	}
+	return raw.Add(bounds.Min)
+}
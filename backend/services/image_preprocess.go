@@ -0,0 +1,249 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"emoji-maker-backend/config"
+
+	"golang.org/x/image/draw"
+)
+
+// 输入图片适配画面比例的方式
+const (
+	ImageFitCrop = "crop" // 从中心裁剪掉超出画面的部分
+	ImageFitPad  = "pad"  // 保留完整图片，用黑色填充画面的空白部分
+)
+
+// previewJPEGQuality 预处理后图片的JPEG压缩质量
+const previewJPEGQuality = 90
+
+// aspectRatios 支持的画面比例，未指定时选择与图片最接近的比例
+var aspectRatios = []string{"16:9", "9:16", "1:1", "4:3", "3:4"}
+
+// frameSizes 各分辨率档位下每种画面比例的尺寸，与DashScope生成的视频尺寸一致
+var frameSizes = map[string]map[string][2]int{
+	"480P": {
+		"16:9": {832, 480},
+		"9:16": {480, 832},
+		"1:1":  {624, 624},
+		"4:3":  {640, 480},
+		"3:4":  {480, 640},
+	},
+	"720P": {
+		"16:9": {1280, 720},
+		"9:16": {720, 1280},
+		"1:1":  {960, 960},
+		"4:3":  {1088, 832},
+		"3:4":  {832, 1088},
+	},
+	"1080P": {
+		"16:9": {1920, 1080},
+		"9:16": {1080, 1920},
+		"1:1":  {1440, 1440},
+		"4:3":  {1632, 1248},
+		"3:4":  {1248, 1632},
+	},
+}
+
+// ImageOptions 输入图片的预处理参数
+type ImageOptions struct {
+	Resolution  string `json:"resolution"`
+	AspectRatio string `json:"aspect_ratio,omitempty"` // 为空时选择与图片最接近的比例
+	Fit         string `json:"fit,omitempty"`          // crop 或 pad，为空时为crop
+}
+
+// ValidateImageOptions 校验预处理参数
+func ValidateImageOptions(opts ImageOptions) error {
+	if opts.AspectRatio != "" && !slices.Contains(aspectRatios, opts.AspectRatio) {
+		return fmt.Errorf("Invalid aspect_ratio. Must be one of %s", strings.Join(aspectRatios, ", "))
+	}
+	if opts.Fit != "" && opts.Fit != ImageFitCrop && opts.Fit != ImageFitPad {
+		return fmt.Errorf("Invalid fit. Must be 'crop' or 'pad'")
+	}
+	return nil
+}
+
+// preprocessSlots 限制同时预处理的图片数，解码后的图片按每像素4字节占用内存
+var (
+	preprocessSlots     chan struct{}
+	preprocessSlotsOnce sync.Once
+)
+
+// acquirePreprocessSlot 等待空闲的预处理名额，返回释放名额的函数
+func acquirePreprocessSlot() func() {
+	preprocessSlotsOnce.Do(func() {
+		preprocessSlots = make(chan struct{}, max(config.AppConfig.Upload.Concurrency, 1))
+	})
+	preprocessSlots <- struct{}{}
+	return func() { <-preprocessSlots }
+}
+
+// PreprocessInputImage 按EXIF方向摆正图片，裁剪或填充到画面比例，并缩小到分辨率档位的尺寸
+// 结果重新编码为JPEG，EXIF、GPS等元数据不会保留；返回的图片就是提交给模型的画面
+func PreprocessInputImage(img *InputImage, opts ImageOptions) (*InputImage, error) {
+	if err := ValidateImageOptions(opts); err != nil {
+		return nil, err
+	}
+
+	defer acquirePreprocessSlot()()
+	src, _, err := image.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid image: %v", err)
+	}
+
+	// 裁剪和缩放的尺寸按摆正后的方向计算，旋转放在缩小之后，只处理输出大小的图片
+	orientation := exifOrientation(img.Data, img.MIME)
+	rawBounds := src.Bounds()
+	w, h := rawBounds.Dx(), rawBounds.Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+
+	ratio := opts.AspectRatio
+	if ratio == "" {
+		ratio = nearestAspectRatio(w, h)
+	}
+	frameW, frameH, err := frameSize(opts.Resolution, ratio)
+	if err != nil {
+		return nil, err
+	}
+
+	// 画布为与画面比例相同、刚好能容纳(填充)或被图片覆盖(裁剪)的区域，
+	// srcRect为使用的图片区域，imageRect为图片在输出画面中的位置，均为摆正后的坐标
+	var canvasW, canvasH int
+	srcRect := image.Rect(0, 0, w, h)
+	switch opts.Fit {
+	case ImageFitPad:
+		canvasW, canvasH = w, w*frameH/frameW
+		if canvasH < h {
+			canvasW, canvasH = h*frameW/frameH, h
+		}
+	default:
+		canvasW, canvasH = w, w*frameH/frameW
+		if canvasH > h {
+			canvasW, canvasH = h*frameW/frameH, h
+		}
+		offsetX, offsetY := (w-canvasW)/2, (h-canvasH)/2
+		srcRect = image.Rect(offsetX, offsetY, offsetX+canvasW, offsetY+canvasH)
+	}
+
+	// 只缩小不放大
+	outW, outH := canvasW, canvasH
+	if outW > frameW || outH > frameH {
+		outW, outH = frameW, frameH
+	}
+	minSide := config.AppConfig.Upload.MinImageSide
+	if outW < minSide || outH < minSide {
+		return nil, fmt.Errorf("Image is too small for aspect ratio %s, got %dx%d after %s, width and height must be at least %d pixels", ratio, outW, outH, fitName(opts.Fit), minSide)
+	}
+
+	scale := float64(outW) / float64(canvasW)
+	imageRect := image.Rect(0, 0, outW, outH)
+	if opts.Fit == ImageFitPad {
+		offsetX, offsetY := float64(canvasW-w)/2*scale, float64(canvasH-h)/2*scale
+		imageRect = image.Rect(
+			int(math.Round(offsetX)), int(math.Round(offsetY)),
+			int(math.Round(offsetX+float64(w)*scale)), int(math.Round(offsetY+float64(h)*scale)),
+		)
+	}
+
+	// 在原始方向上把使用的区域缩小到输出大小，再摆正
+	scaledW, scaledH := imageRect.Dx(), imageRect.Dy()
+	if orientation >= 5 {
+		scaledW, scaledH = scaledH, scaledW
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, scaledW, scaledH))
+	scaleImage(scaled, src, unorientRect(srcRect, orientation, rawBounds))
+	upright := applyOrientation(scaled, orientation)
+
+	dst := image.NewRGBA(image.Rect(0, 0, outW, outH))
+	draw.Draw(dst, dst.Bounds(), image.Black, image.Point{}, draw.Src)
+	draw.Draw(dst, imageRect, upright, image.Point{}, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: previewJPEGQuality}); err != nil {
+		return nil, fmt.Errorf("Failed to encode image: %v", err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return &InputImage{
+		Data:   buf.Bytes(),
+		MIME:   "image/jpeg",
+		Width:  outW,
+		Height: outH,
+		SHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// scaleImage 将src中的srcRect区域缩放到dst
+// CatmullRom的中间缓冲区与目标宽度和源图高度的乘积成正比，源图很大时先用近似双线性缩小到目标的两倍以内，限制内存占用
+func scaleImage(dst *image.RGBA, src image.Image, srcRect image.Rectangle) {
+	dw, dh := dst.Bounds().Dx(), dst.Bounds().Dy()
+	if srcRect.Dx() > 2*dw || srcRect.Dy() > 2*dh {
+		reduced := image.NewRGBA(image.Rect(0, 0, min(srcRect.Dx(), 2*dw), min(srcRect.Dy(), 2*dh)))
+		draw.ApproxBiLinear.Scale(reduced, reduced.Bounds(), src, srcRect, draw.Src, nil)
+		src, srcRect = reduced, reduced.Bounds()
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Src, nil)
+}
+
+// nearestAspectRatio 选择与图片宽高比最接近的画面比例
+func nearestAspectRatio(w, h int) string {
+	best, bestDiff := aspectRatios[0], math.Inf(1)
+	for _, ratio := range aspectRatios {
+		rw, rh := parseAspectRatio(ratio)
+		diff := math.Abs(math.Log(float64(w)/float64(h)) - math.Log(float64(rw)/float64(rh)))
+		if diff < bestDiff {
+			best, bestDiff = ratio, diff
+		}
+	}
+	return best
+}
+
+// parseAspectRatio 解析 宽:高 格式的画面比例
+func parseAspectRatio(ratio string) (int, int) {
+	wText, hText, _ := strings.Cut(ratio, ":")
+	w, _ := strconv.Atoi(wText)
+	h, _ := strconv.Atoi(hText)
+	return w, h
+}
+
+// frameSize 得到分辨率档位和画面比例对应的画面尺寸
+// 不在预设表中的档位(例如540P)按短边为档位数值、长边按比例取16的倍数计算
+func frameSize(resolution, ratio string) (int, int, error) {
+	if size, ok := frameSizes[resolution][ratio]; ok {
+		return size[0], size[1], nil
+	}
+
+	short, err := strconv.Atoi(strings.TrimSuffix(resolution, "P"))
+	if err != nil || !strings.HasSuffix(resolution, "P") || short <= 0 {
+		return 0, 0, fmt.Errorf("Unsupported resolution %s for image preprocessing", resolution)
+	}
+	rw, rh := parseAspectRatio(ratio)
+	if rw >= rh {
+		return roundTo16(short * rw / rh), short, nil
+	}
+	return short, roundTo16(short * rh / rw), nil
+}
+
+// roundTo16 取最接近的16的倍数
+func roundTo16(n int) int {
+	return (n + 8) / 16 * 16
+}
+
+// fitName 适配方式的说明，用于错误信息
+func fitName(fit string) string {
+	if fit == ImageFitPad {
+		return "padding"
+	}
+	return "cropping"
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"emoji-maker-backend/config"
+)
+
+var (
+	quadrantTopLeft     = color.RGBA{255, 0, 0, 255}
+	quadrantTopRight    = color.RGBA{0, 255, 0, 255}
+	quadrantBottomLeft  = color.RGBA{0, 0, 255, 255}
+	quadrantBottomRight = color.RGBA{255, 255, 255, 255}
+)
+
+// orientedPNG 生成摆正后为w×h、四个象限颜色不同的图片，按EXIF方向存储像素并写入eXIf块
+func orientedPNG(t *testing.T, w, h, orientation int) []byte {
+	t.Helper()
+	rawW, rawH := w, h
+	if orientation >= 5 {
+		rawW, rawH = h, w
+	}
+	raw := image.NewRGBA(image.Rect(0, 0, rawW, rawH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := quadrantTopLeft
+			switch {
+			case x >= w/2 && y < h/2:
+				c = quadrantTopRight
+			case x < w/2 && y >= h/2:
+				c = quadrantBottomLeft
+			case x >= w/2 && y >= h/2:
+				c = quadrantBottomRight
+			}
+			// 与applyOrientation相反的映射：摆正后的(x, y)来自原始图片的(sx, sy)
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = rawW-1-x, y
+			case 3:
+				sx, sy = rawW-1-x, rawH-1-y
+			case 4:
+				sx, sy = x, rawH-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, rawH-1-x
+			case 7:
+				sx, sy = rawW-1-y, rawH-1-x
+			case 8:
+				sx, sy = rawW-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			raw.SetRGBA(sx, sy, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, raw); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// 只有方向标签的大端TIFF数据
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], uint16(orientation))
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(tiff)))
+	chunk = append(chunk, "eXIf"...)
+	chunk = append(chunk, tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// eXIf块放在IHDR之后
+	const ihdrEnd = 8 + 8 + 13 + 4
+	return append(append(append([]byte(nil), data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+}
+
+// assertColor 检查像素颜色与期望的颜色接近，JPEG压缩会带来少量误差
+func assertColor(t *testing.T, img image.Image, x, y int, want color.RGBA) {
+	t.Helper()
+	r, g, b, _ := img.At(x, y).RGBA()
+	got := [3]int{int(r >> 8), int(g >> 8), int(b >> 8)}
+	for i, v := range [3]uint8{want.R, want.G, want.B} {
+		if diff := got[i] - int(v); diff > 40 || diff < -40 {
+			t.Errorf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			return
+		}
+	}
+}
+
+// setUploadConfig 使用默认的图片限制，测试结束后恢复
+func setUploadConfig(t *testing.T) {
+	saved := config.AppConfig.Upload
+	t.Cleanup(func() { config.AppConfig.Upload = saved })
+	config.AppConfig.Upload.MaxImageMB = 10
+	config.AppConfig.Upload.MinImageSide = 360
+	config.AppConfig.Upload.MaxImageSide = 8192
+	config.AppConfig.Upload.MaxImageMP = 40
+}
+
+func TestPreprocessInputImageOrientation(t *testing.T) {
+	setUploadConfig(t)
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		data := orientedPNG(t, 800, 600, orientation)
+		img, err := ParseInputImage(data)
+		if err != nil {
+			t.Fatalf("orientation %d: ParseInputImage() error = %v", orientation, err)
+		}
+		if got := exifOrientation(data, img.MIME); got != orientation {
+			t.Fatalf("exifOrientation() = %d, want %d", got, orientation)
+		}
+
+		tests := []struct {
+			name       string
+			opts       ImageOptions
+			wantW      int
+			wantH      int
+			imageLeft  int // 图片在输出中的左边界，左侧为填充的黑边
+			imageRight int
+		}{
+			{name: "nearest", opts: ImageOptions{Resolution: "480P"}, wantW: 640, wantH: 480, imageLeft: 0, imageRight: 640},
+			{name: "crop", opts: ImageOptions{Resolution: "480P", AspectRatio: "1:1"}, wantW: 600, wantH: 600, imageLeft: 0, imageRight: 600},
+			{name: "pad", opts: ImageOptions{Resolution: "480P", AspectRatio: "16:9", Fit: ImageFitPad}, wantW: 832, wantH: 480, imageLeft: 96, imageRight: 736},
+		}
+		for _, tt := range tests {
+			processed, err := PreprocessInputImage(img, tt.opts)
+			if err != nil {
+				t.Fatalf("orientation %d %s: PreprocessInputImage() error = %v", orientation, tt.name, err)
+			}
+			out, err := jpeg.Decode(bytes.NewReader(processed.Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := out.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH || processed.Width != tt.wantW || processed.Height != tt.wantH {
+				t.Fatalf("orientation %d %s: size = %dx%d, want %dx%d", orientation, tt.name, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+
+			const inset = 20
+			left, right := tt.imageLeft+inset, tt.imageRight-inset
+			assertColor(t, out, left, inset, quadrantTopLeft)
+			assertColor(t, out, right, inset, quadrantTopRight)
+			assertColor(t, out, left, tt.wantH-inset, quadrantBottomLeft)
+			assertColor(t, out, right, tt.wantH-inset, quadrantBottomRight)
+			if tt.imageLeft > 0 {
+				assertColor(t, out, tt.imageLeft/2, tt.wantH/2, color.RGBA{0, 0, 0, 255})
+			}
+		}
+	}
+}
+
+func TestParseInputImageRejectsTooManyPixels(t *testing.T) {
+	setUploadConfig(t)
+	config.AppConfig.Upload.MaxImageMP = 1
+
+	if _, err := ParseInputImage(orientedPNG(t, 1200, 900, 1)); err == nil {
+		t.Error("ParseInputImage() of a 1.08 megapixel image with a 1 megapixel limit succeeded, want error")
+	}
+	if _, err := ParseInputImage(orientedPNG(t, 1000, 1000, 1)); err != nil {
+		t.Errorf("ParseInputImage() of a 1 megapixel image error = %v", err)
+	}
+}
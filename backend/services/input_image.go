@@ -0,0 +1,106 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"emoji-maker-backend/config"
+
+	_ "golang.org/x/image/webp"
+)
+
+// inputImageFormats 允许上传的图片格式，按内容识别的MIME类型对应的文件扩展名
+var inputImageFormats = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// InputImage 经过校验的图生视频输入图片
+type InputImage struct {
+	Data   []byte `json:"-"`
+	MIME   string `json:"mime"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	SHA256 string `json:"sha256"` // 图片内容的摘要，用于判断幂等请求的参数是否相同
+}
+
+// MaxInputImageBytes 上传图片的最大字节数
+func MaxInputImageBytes() int64 {
+	return config.AppConfig.Upload.MaxImageMB * 1024 * 1024
+}
+
+// ParseInputImage 按内容识别图片格式并校验体积和宽高，不信任客户端声明的文件类型
+func ParseInputImage(data []byte) (*InputImage, error) {
+	cfg := config.AppConfig.Upload
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Image is empty")
+	}
+	if int64(len(data)) > MaxInputImageBytes() {
+		return nil, fmt.Errorf("Image must be at most %d MB", cfg.MaxImageMB)
+	}
+
+	mime := http.DetectContentType(data)
+	if _, ok := inputImageFormats[mime]; !ok {
+		return nil, fmt.Errorf("Unsupported image format %s, must be JPEG, PNG or WebP", mime)
+	}
+
+	// 只解析图片头部得到宽高，不解码像素
+	header, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid image: %v", err)
+	}
+	if header.Width < cfg.MinImageSide || header.Height < cfg.MinImageSide {
+		return nil, fmt.Errorf("Image width and height must be at least %d pixels, got %dx%d", cfg.MinImageSide, header.Width, header.Height)
+	}
+	if header.Width > cfg.MaxImageSide || header.Height > cfg.MaxImageSide {
+		return nil, fmt.Errorf("Image width and height must be at most %d pixels, got %dx%d", cfg.MaxImageSide, header.Width, header.Height)
+	}
+	// 预处理时需要解码全部像素，按像素数限制解码占用的内存
+	if cfg.MaxImageMP > 0 && header.Width*header.Height > cfg.MaxImageMP*1000*1000 {
+		return nil, fmt.Errorf("Image must be at most %d megapixels, got %dx%d", cfg.MaxImageMP, header.Width, header.Height)
+	}
+
+	sum := sha256.Sum256(data)
+	return &InputImage{
+		Data:   data,
+		MIME:   mime,
+		Width:  header.Width,
+		Height: header.Height,
+		SHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// SaveInputImage 将输入图片保存到输入目录，返回本地路径
+// 输入目录不通过静态文件服务公开，批量创建的任务共用同一个文件，文件在不再被任何任务引用后由清理服务删除
+func SaveInputImage(img *InputImage) (string, error) {
+	dir := config.AppConfig.Upload.Dir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("Failed to save image: %v", err)
+	}
+	name, err := randomFileName(inputImageFormats[img.MIME])
+	if err != nil {
+		return "", fmt.Errorf("Failed to save image: %v", err)
+	}
+
+	// 先写入临时文件再重命名，提交时不会读到写了一半的文件
+	path := filepath.Join(dir, name)
+	partPath := path + ".part"
+	if err := os.WriteFile(partPath, img.Data, 0644); err != nil {
+		os.Remove(partPath)
+		return "", fmt.Errorf("Failed to save image: %v", err)
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		os.Remove(partPath)
+		return "", fmt.Errorf("Failed to save image: %v", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// JobCanceler 跟踪任务在本地进行中的工作(提交协程、GIF转换等)，以便取消任务时一并中止
+type JobCanceler interface {
+	// Track 登记一项本地工作，返回的ctx会在任务被取消时取消，工作结束后需调用done
+	Track(jobID string) (ctx context.Context, done func())
+	// Cancel 取消任务所有进行中的本地工作
+	Cancel(jobID string)
+}
+
+// jobCancelerImpl 任务取消器实现
+type jobCancelerImpl struct {
+	mu      sync.Mutex
+	nextID  int
+	cancels map[string]map[int]context.CancelFunc
+}
+
+// NewJobCanceler 创建任务取消器实例
+func NewJobCanceler() JobCanceler {
+	return &jobCancelerImpl{
+		cancels: make(map[string]map[int]context.CancelFunc),
+	}
+}
+
+// Track 登记一项本地工作
+func (c *jobCancelerImpl) Track(jobID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	id := c.nextID
+	if c.cancels[jobID] == nil {
+		c.cancels[jobID] = make(map[int]context.CancelFunc)
+	}
+	c.cancels[jobID][id] = cancel
+
+	return ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.cancels[jobID], id)
+		if len(c.cancels[jobID]) == 0 {
+			delete(c.cancels, jobID)
+		}
+		cancel()
+	}
+}
+
+// Cancel 取消任务所有进行中的本地工作
+func (c *jobCancelerImpl) Cancel(jobID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cancel := range c.cancels[jobID] {
+		cancel()
+	}
+	delete(c.cancels, jobID)
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"log"
+	"sync"
+
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/repositories"
+)
+
+// jobEventBufferSize 每个订阅者的事件缓冲区大小
+const jobEventBufferSize = 32
+
+// JobEventBroker 任务状态变化事件的发布订阅中心
+type JobEventBroker interface {
+	// Publish 发布任务的最新状态，状态与上次发布相同时忽略
+	Publish(job *models.Job)
+	// Subscribe 订阅用户所有任务的状态变化，使用完毕后需调用unsubscribe
+	Subscribe(userID int64) (events <-chan models.Job, unsubscribe func())
+	// AddListener 注册在每次发布时同步调用的监听函数，监听函数不能阻塞
+	// 与订阅不同，监听函数不会因缓冲区已满而丢失事件
+	AddListener(listener func(job models.Job))
+}
+
+// jobEventBrokerImpl 任务事件发布订阅中心实现
+type jobEventBrokerImpl struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[chan models.Job]struct{}
+	lastStatus  map[string]string // 每个进行中任务最后发布的状态，用于去重
+	listeners   []func(job models.Job)
+}
+
+// NewJobEventBroker 创建任务事件发布订阅中心实例
+func NewJobEventBroker() JobEventBroker {
+	return &jobEventBrokerImpl{
+		subscribers: make(map[int64]map[chan models.Job]struct{}),
+		lastStatus:  make(map[string]string),
+	}
+}
+
+// Publish 发布任务的最新状态
+func (b *jobEventBrokerImpl) Publish(job *models.Job) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.lastStatus[job.JobID] == job.Status {
+		return
+	}
+	if job.IsTerminal() {
+		delete(b.lastStatus, job.JobID)
+	} else {
+		b.lastStatus[job.JobID] = job.Status
+	}
+
+	for _, listener := range b.listeners {
+		listener(*job)
+	}
+
+	for ch := range b.subscribers[job.UserID] {
+		select {
+		case ch <- *job:
+		default:
+			// 订阅者处理过慢时丢弃事件，客户端可通过查询接口获取最新状态
+			log.Printf("任务 %s 的事件订阅者缓冲区已满，丢弃 %s 事件", job.JobID, job.Status)
+		}
+	}
+}
+
+// Subscribe 订阅用户所有任务的状态变化
+func (b *jobEventBrokerImpl) Subscribe(userID int64) (<-chan models.Job, func()) {
+	ch := make(chan models.Job, jobEventBufferSize)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan models.Job]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[userID], ch)
+		if len(b.subscribers[userID]) == 0 {
+			delete(b.subscribers, userID)
+		}
+	}
+}
+
+// AddListener 注册监听函数
+func (b *jobEventBrokerImpl) AddListener(listener func(job models.Job)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, listener)
+}
+
+// publishingJobRepository 在任务写入成功后发布状态事件的仓库装饰器，
+// 这样所有修改任务状态的流程(创建、提交、轮询、取消、重试)都会自动产生事件
+type publishingJobRepository struct {
+	repositories.JobRepository
+	broker JobEventBroker
+}
+
+// NewPublishingJobRepository 创建发布状态事件的任务仓库
+func NewPublishingJobRepository(jobRepo repositories.JobRepository, broker JobEventBroker) repositories.JobRepository {
+	return &publishingJobRepository{JobRepository: jobRepo, broker: broker}
+}
+
+// Create 创建任务并发布初始状态
+func (r *publishingJobRepository) Create(job *models.Job) error {
+	if err := r.JobRepository.Create(job); err != nil {
+		return err
+	}
+	r.broker.Publish(job)
+	return nil
+}
+
+// UpdateIfActive 更新成功时发布状态
+func (r *publishingJobRepository) UpdateIfActive(job *models.Job) (bool, error) {
+	return r.UpdateIfStatus(job, models.ActiveStatuses...)
+}
+
+// UpdateIfStatus 更新成功时发布状态
+func (r *publishingJobRepository) UpdateIfStatus(job *models.Job, statuses ...string) (bool, error) {
+	updated, err := r.JobRepository.UpdateIfStatus(job, statuses...)
+	if updated {
+		r.broker.Publish(job)
+	}
+	return updated, err
+}
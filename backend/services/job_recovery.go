@@ -0,0 +1,55 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/repositories"
+)
+
+// RecoverJobs 服务启动时恢复上次退出时未结束的任务，需在调度器和轮询器启动前调用:
+//   - 已有上游任务ID的任务由后台轮询器继续查询，转换中断的任务由轮询器重新下载和转换，
+//     这些任务同时计入调度器的名额
+//   - 尚未提交的PENDING任务重新加入提交队列
+//   - 提交过程中断的RUNNING任务无法确定上游是否已经受理，为避免重复计费直接标记为失败，用户可以手动重试
+//   - 原始视频地址已过期的转换任务无法再下载，标记为失败
+func RecoverJobs(jobRepo repositories.JobRepository, scheduler JobScheduler) error {
+	jobs, err := jobRepo.FindUnfinished()
+	if err != nil {
+		return err
+	}
+
+	var reattached, requeued, failed int
+	for _, job := range jobs {
+		switch {
+		case job.Status == models.TaskConverting && !time.Now().Before(job.VideoExpiresAt):
+			err = job.Fail(models.JobStepDownload, "服务重启时视频地址已过期")
+		case job.UpstreamTaskID != "":
+			scheduler.Observe(*job)
+			reattached++
+			continue
+		case job.Status == models.TaskPending:
+			scheduler.Enqueue(job)
+			requeued++
+			continue
+		default:
+			err = job.Fail(models.JobStepSubmit, "服务重启时任务提交中断")
+		}
+		if err != nil {
+			log.Printf("任务 %s 标记失败时出错: %v", job.JobID, err)
+			continue
+		}
+
+		if _, err := jobRepo.UpdateIfActive(job); err != nil {
+			log.Printf("保存任务 %s 失败: %v", job.JobID, err)
+			continue
+		}
+		failed++
+	}
+
+	if len(jobs) > 0 {
+		log.Printf("恢复未结束的任务: 继续处理 %d 个，重新排队 %d 个，标记失败 %d 个", reattached, requeued, failed)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"emoji-maker-backend/config"
+	"emoji-maker-backend/models"
+)
+
+// QueryTaskResponse 查询任务结果响应
+type QueryTaskResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	Data    struct {
+		JobID         string            `json:"job_id"`
+		Status        string            `json:"status"`
+		Stage         string            `json:"stage"` // 任务的实际状态，查询接口为兼容旧客户端会合并部分状态，其余接口与status相同
+		Model         string            `json:"model,omitempty"`
+		Seed          int               `json:"seed"` // 实际使用的随机种子，可用于复现或微调生成结果
+		VideoURL      string            `json:"video_url,omitempty"`
+		ErrorMessage  string            `json:"error_message,omitempty"`
+		RetryCount    int               `json:"retry_count,omitempty"`
+		ErrorHistory  []models.JobError `json:"error_history,omitempty"` // 每次执行失败的记录
+		Prompts       JobPrompts        `json:"prompts"`
+		InputImageURL string            `json:"input_image_url,omitempty"` // 预处理后提交给模型的输入图片，需携带令牌访问
+		Usage         *JobUsage         `json:"usage,omitempty"`           // 任务已产生的用量，尚未产生用量时不返回
+	} `json:"data"`
+}
+
+// JobPrompts 任务在各个阶段的提示词
+type JobPrompts struct {
+	RolePrompt     string `json:"role_prompt,omitempty"` // 文本模型根据角色生成的描述，仅create_with_prompt创建的任务
+	FinalPrompt    string `json:"final_prompt"`          // 提交给视频模型的提示词
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	OrigPrompt     string `json:"orig_prompt,omitempty"`   // 上游记录的原始提示词，上游生成完成后返回
+	ActualPrompt   string `json:"actual_prompt,omitempty"` // 开启提示词扩写时模型实际使用的提示词，上游生成完成后返回
+}
+
+// JobUsage 任务的用量和估算费用
+type JobUsage struct {
+	TextModel    string  `json:"text_model,omitempty"`
+	TextTokens   int     `json:"text_tokens,omitempty"`
+	VideoSeconds int     `json:"video_seconds,omitempty"` // 上游生成的视频总时长(秒)，重试后重新生成的视频也计算在内
+	Cost         float64 `json:"cost"`                    // 按模型价格估算的费用(元)
+}
+
+// NewQueryTaskResponse 根据任务记录构造任务响应，SSE事件、Webhook回调和取消、重试接口共用，查询接口见NewCompatQueryTaskResponse
+func NewQueryTaskResponse(job *models.Job) QueryTaskResponse {
+	response := QueryTaskResponse{
+		Code: 200,
+	}
+	response.Data.JobID = job.JobID
+	response.Data.Status = job.Status
+	response.Data.Stage = job.Status
+	response.Data.Model = job.Model
+	response.Data.Seed = job.Seed
+
+	if job.Status == models.TaskSucceeded {
+		response.Data.VideoURL = job.OutputURL
+	} else if job.Status == models.TaskFailed {
+		if job.Error != "" {
+			response.Data.ErrorMessage = job.Error
+		} else {
+			response.Data.ErrorMessage = "视频生成失败"
+		}
+	}
+	response.Data.RetryCount = job.RetryCount
+	response.Data.ErrorHistory = job.ErrorHistory
+	response.Data.InputImageURL = InputImageURL(job)
+	response.Data.Prompts = JobPrompts{
+		RolePrompt:     job.RolePrompt,
+		FinalPrompt:    job.Prompt,
+		NegativePrompt: job.NegativePrompt,
+		OrigPrompt:     job.OrigPrompt,
+		ActualPrompt:   job.ActualPrompt,
+	}
+	if job.TextTokens > 0 || job.VideoSeconds > 0 {
+		response.Data.Usage = &JobUsage{
+			TextModel:    job.TextModel,
+			TextTokens:   job.TextTokens,
+			VideoSeconds: job.VideoSeconds,
+			Cost:         job.Cost,
+		}
+	}
+	return response
+}
+
+// NewCompatQueryTaskResponse 构造查询接口的响应，status只返回旧版客户端认识的PENDING、RUNNING、SUCCEEDED和FAILED
+// 已发布的小程序和App遇到其他状态会停止轮询，转换中的任务按RUNNING返回，已取消的任务按FAILED返回，实际状态见stage
+func NewCompatQueryTaskResponse(job *models.Job) QueryTaskResponse {
+	response := NewQueryTaskResponse(job)
+	switch job.Status {
+	case models.TaskConverting:
+		response.Data.Status = models.TaskRunning
+	case models.TaskCanceled:
+		response.Data.Status = models.TaskFailed
+		response.Data.ErrorMessage = "任务已取消"
+	}
+	return response
+}
+
+// InputImageURL 任务输入图片的访问地址，输入图片不公开，需通过接口携带令牌访问，没有输入图片时返回空
+func InputImageURL(job *models.Job) string {
+	if job.InputImagePath == "" {
+		return ""
+	}
+	return "https://" + config.AppConfig.Server.Host + ":" + config.AppConfig.Server.Port + "/api/v1/video/input/" + job.JobID
+}
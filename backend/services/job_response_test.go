@@ -0,0 +1,35 @@
+package services
+
+import (
+	"testing"
+
+	"emoji-maker-backend/models"
+)
+
+func TestNewCompatQueryTaskResponse(t *testing.T) {
+	tests := []struct {
+		status       string
+		wantStatus   string
+		wantErrorMsg string
+	}{
+		{status: models.TaskPending, wantStatus: models.TaskPending},
+		{status: models.TaskRunning, wantStatus: models.TaskRunning},
+		{status: models.TaskConverting, wantStatus: models.TaskRunning},
+		{status: models.TaskSucceeded, wantStatus: models.TaskSucceeded},
+		{status: models.TaskFailed, wantStatus: models.TaskFailed, wantErrorMsg: "upstream error"},
+		{status: models.TaskCanceled, wantStatus: models.TaskFailed, wantErrorMsg: "任务已取消"},
+	}
+	for _, tt := range tests {
+		job := &models.Job{JobID: "job_a", Status: tt.status, Error: "upstream error"}
+		response := NewCompatQueryTaskResponse(job)
+		if response.Data.Status != tt.wantStatus || response.Data.Stage != tt.status || response.Data.ErrorMessage != tt.wantErrorMsg {
+			t.Errorf("%s: status %s, stage %s, error %q, want %s, %s, %q", tt.status,
+				response.Data.Status, response.Data.Stage, response.Data.ErrorMessage, tt.wantStatus, tt.status, tt.wantErrorMsg)
+		}
+
+		// 其余接口返回实际状态
+		if full := NewQueryTaskResponse(job); full.Data.Status != tt.status {
+			t.Errorf("NewQueryTaskResponse() status = %s, want %s", full.Data.Status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"emoji-maker-backend/config"
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/providers"
+	"emoji-maker-backend/repositories"
+)
+
+// upstreamCancelTimeout 请求视频生成服务取消任务的超时时间
+const upstreamCancelTimeout = 10 * time.Second
+
+// JobScheduler 将待提交的任务排队，按用户轮转公平地提交到视频生成服务
+type JobScheduler interface {
+	// Enqueue 将PENDING状态的任务加入所属用户的队列，任务在有空闲名额前保持PENDING
+	Enqueue(job *models.Job)
+	// Observe 根据任务的最新状态更新占用的名额，可直接注册为JobEventBroker的监听函数
+	Observe(job models.Job)
+	Start()
+	Stop()
+}
+
+// jobSchedulerImpl 任务提交调度器实现
+// 任务从提交开始直到结束或重新回到待提交状态都占用一个名额，
+// 全局名额和每个用户的名额都有上限，有空闲名额时按用户轮转从各自队列中取出任务提交
+type jobSchedulerImpl struct {
+	jobRepo       repositories.JobRepository
+	provider      providers.VideoProvider
+	canceler      JobCanceler
+	maxConcurrent int
+	maxPerUser    int
+	circuitDelay  time.Duration // 上游熔断时暂停提交的时间，上游限流时按其要求的时间暂停
+
+	mu          sync.Mutex
+	queues      map[int64][]*models.Job // 每个用户排队中的任务，先进先出
+	order       []int64                 // 有排队任务的用户，按轮转顺序排列
+	next        int                     // 下一次从order中开始查找的位置
+	inFlight    map[string]int64        // 占用名额的任务及其所属用户
+	perUser     map[int64]int           // 每个用户占用的名额数
+	pausedUntil time.Time               // 上游熔断期间暂停提交，排队的任务保持PENDING
+
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewJobScheduler 创建任务提交调度器实例
+func NewJobScheduler(jobRepo repositories.JobRepository, provider providers.VideoProvider, canceler JobCanceler) JobScheduler {
+	return &jobSchedulerImpl{
+		jobRepo:       jobRepo,
+		provider:      provider,
+		canceler:      canceler,
+		maxConcurrent: config.AppConfig.Queue.MaxConcurrent,
+		maxPerUser:    config.AppConfig.Queue.MaxPerUser,
+		circuitDelay:  config.AppConfig.Upstream.BreakerCooldown,
+		queues:        make(map[int64][]*models.Job),
+		inFlight:      make(map[string]int64),
+		perUser:       make(map[int64]int),
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+}
+
+// Enqueue 将任务加入所属用户的队列
+func (s *jobSchedulerImpl) Enqueue(job *models.Job) {
+	s.mu.Lock()
+	if len(s.queues[job.UserID]) == 0 {
+		s.order = append(s.order, job.UserID)
+	}
+	s.queues[job.UserID] = append(s.queues[job.UserID], job)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// Observe 根据任务的最新状态更新名额，同时移除排队期间被取消的任务
+func (s *jobSchedulerImpl) Observe(job models.Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch job.Status {
+	case models.TaskRunning, models.TaskConverting:
+		// 重试等不经过队列的任务直接计入名额
+		s.acquire(job.JobID, job.UserID)
+		return
+	case models.TaskPending:
+		// 已提交但仍在上游排队的任务同样占用名额
+		if job.UpstreamTaskID != "" {
+			s.acquire(job.JobID, job.UserID)
+		} else {
+			s.release(job.JobID)
+		}
+		return
+	}
+
+	// 任务已结束，释放名额，并从队列中移除
+	s.release(job.JobID)
+	s.unqueue(job.JobID, job.UserID)
+}
+
+// Start 启动调度协程
+func (s *jobSchedulerImpl) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Stop 停止调度并等待进行中的提交结束，仍在排队的任务保持PENDING
+func (s *jobSchedulerImpl) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// signal 唤醒调度协程，不阻塞调用方
+func (s *jobSchedulerImpl) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run 在任务入队或名额释放时尝试派发任务
+func (s *jobSchedulerImpl) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		}
+
+		for {
+			job := s.dequeue()
+			if job == nil {
+				break
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.submit(job)
+			}()
+		}
+	}
+}
+
+// dequeue 从下一个有空闲名额的用户队列中取出任务并占用名额，没有可派发的任务时返回nil
+func (s *jobSchedulerImpl) dequeue() *models.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 清理已经没有排队任务的用户
+	order := s.order[:0]
+	for i, userID := range s.order {
+		if len(s.queues[userID]) > 0 {
+			order = append(order, userID)
+		} else {
+			delete(s.queues, userID)
+			if i < s.next {
+				s.next--
+			}
+		}
+	}
+	s.order = order
+
+	if len(s.inFlight) >= s.maxConcurrent || len(s.order) == 0 || time.Now().Before(s.pausedUntil) {
+		return nil
+	}
+
+	for i := 0; i < len(s.order); i++ {
+		index := (s.next + i) % len(s.order)
+		userID := s.order[index]
+		if s.perUser[userID] >= s.maxPerUser {
+			continue
+		}
+
+		job := s.queues[userID][0]
+		s.queues[userID] = s.queues[userID][1:]
+		s.acquire(job.JobID, userID)
+		s.next = index + 1
+		return job
+	}
+	return nil
+}
+
+// requeue 将提交未成功的任务放回所属用户队列的最前面，需持有锁
+func (s *jobSchedulerImpl) requeue(job *models.Job) {
+	if len(s.queues[job.UserID]) == 0 {
+		s.order = append(s.order, job.UserID)
+	}
+	s.queues[job.UserID] = append([]*models.Job{job}, s.queues[job.UserID]...)
+}
+
+// unqueue 从所属用户的队列中移除任务，需持有锁
+func (s *jobSchedulerImpl) unqueue(jobID string, userID int64) {
+	queue := s.queues[userID]
+	for i, queued := range queue {
+		if queued.JobID == jobID {
+			s.queues[userID] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+}
+
+// acquire 记录任务占用名额，需持有锁
+func (s *jobSchedulerImpl) acquire(jobID string, userID int64) {
+	if _, ok := s.inFlight[jobID]; ok {
+		return
+	}
+	s.inFlight[jobID] = userID
+	s.perUser[userID]++
+}
+
+// release 释放任务占用的名额并唤醒调度协程，需持有锁
+func (s *jobSchedulerImpl) release(jobID string) {
+	userID, ok := s.inFlight[jobID]
+	if !ok {
+		return
+	}
+	delete(s.inFlight, jobID)
+	if s.perUser[userID]--; s.perUser[userID] == 0 {
+		delete(s.perUser, userID)
+	}
+	s.signal()
+}
+
+// releaseSlot 归还任务占用的名额
+// 名额通常在任务保存后由发布的状态事件释放，保存未成功时没有事件，需要调用方主动归还
+func (s *jobSchedulerImpl) releaseSlot(jobID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(jobID)
+}
+
+// saveJob 持久化任务，任务已进入终态(例如被取消)或保存失败时返回false
+func (s *jobSchedulerImpl) saveJob(job *models.Job) bool {
+	updated, err := s.jobRepo.UpdateIfActive(job)
+	if err != nil {
+		log.Printf("保存任务 %s 失败: %v", job.JobID, err)
+		return false
+	}
+	return updated
+}
+
+// failJob 将任务标记为失败并记录失败的步骤和错误
+func (s *jobSchedulerImpl) failJob(job *models.Job, step, errMsg string) {
+	if err := job.Fail(step, errMsg); err != nil {
+		log.Printf("任务 %s 标记失败时出错: %v", job.JobID, err)
+		s.releaseSlot(job.JobID)
+		return
+	}
+	if !s.saveJob(job) {
+		s.releaseSlot(job.JobID)
+	}
+}
+
+// submit 将任务提交到视频生成服务并保存上游任务ID，后续状态由后台轮询器推进
+func (s *jobSchedulerImpl) submit(job *models.Job) {
+	// 登记本地工作，任务被取消时中止提交
+	ctx, done := s.canceler.Track(job.JobID)
+	defer done()
+
+	// 更新任务状态为运行中
+	if err := job.TransitionTo(models.TaskRunning, models.JobStepSubmit, "开始提交到"+s.provider.Name()); err != nil {
+		log.Printf("任务 %s 状态更新失败: %v", job.JobID, err)
+		s.releaseSlot(job.JobID)
+		return
+	}
+	if !s.saveJob(job) {
+		// 排队期间任务已被取消或保存失败，归还名额
+		s.releaseSlot(job.JobID)
+		return
+	}
+
+	result, err := s.provider.Submit(ctx, submitRequestForJob(job))
+	var retryAfter *providers.RetryAfterError
+	switch {
+	case errors.Is(err, providers.ErrCircuitOpen):
+		// 熔断时请求没有发送到上游，任务回到队列等待熔断结束，不因上游故障清空整个队列
+		s.postpone(job, s.circuitDelay)
+		return
+	case errors.As(err, &retryAfter):
+		// 上游限流且要求长时间等待，请求没有被受理，按上游要求的时间暂停提交
+		s.postpone(job, retryAfter.Wait)
+		return
+	}
+	if err != nil {
+		s.failJob(job, models.JobStepSubmit, err.Error())
+		return
+	}
+
+	// 保存上游任务ID
+	job.UpstreamTaskID = result.TaskID
+	if !s.saveJob(job) {
+		// 提交期间任务已被取消或保存失败，归还名额并请求上游取消刚提交的任务
+		s.releaseSlot(job.JobID)
+		CancelUpstreamTask(s.provider, job.UpstreamTaskID)
+	}
+}
+
+// postpone 将因上游暂时不可用而未提交的任务放回队列，并暂停提交delay时间
+func (s *jobSchedulerImpl) postpone(job *models.Job, delay time.Duration) {
+	if err := job.TransitionTo(models.TaskPending, models.JobStepSubmit, s.provider.Name()+"暂时不可用，等待重新提交"); err != nil {
+		log.Printf("任务 %s 状态更新失败: %v", job.JobID, err)
+		s.releaseSlot(job.JobID)
+		return
+	}
+
+	// 先放回队列再保存，保存后发布的PENDING状态会释放名额，暂停期间不会立即再次提交
+	s.mu.Lock()
+	s.requeue(job)
+	if until := time.Now().Add(delay); until.After(s.pausedUntil) {
+		s.pausedUntil = until
+	}
+	s.mu.Unlock()
+	time.AfterFunc(delay, s.signal)
+
+	if !s.saveJob(job) {
+		// 任务已被取消或保存失败
+		s.mu.Lock()
+		s.release(job.JobID)
+		s.unqueue(job.JobID, job.UserID)
+		s.mu.Unlock()
+	}
+}
+
+// submitRequestForJob 根据任务保存的参数构造提交请求，创建和重试共用
+func submitRequestForJob(job *models.Job) providers.SubmitRequest {
+	return providers.SubmitRequest{
+		Model:          job.Model,
+		Prompt:         job.Prompt,
+		NegativePrompt: job.NegativePrompt,
+		ImagePath:      job.InputImagePath,
+		ImgURL:         job.ImgURL,
+		Size:           job.Size,
+		Resolution:     job.Resolution,
+		Duration:       job.Duration,
+		Seed:           job.Seed,
+		PromptExtend:   job.PromptExtend,
+		Watermark:      job.Watermark,
+	}
+}
+
+// CancelUpstreamTask 请求视频生成服务取消任务，失败时仅记录日志
+func CancelUpstreamTask(provider providers.VideoProvider, taskID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamCancelTimeout)
+	defer cancel()
+	if err := provider.Cancel(ctx, taskID); err != nil {
+		log.Printf("取消%s任务 %s 失败: %v", provider.Name(), taskID, err)
+	}
+}
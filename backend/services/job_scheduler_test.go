@@ -0,0 +1,398 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/providers"
+	"emoji-maker-backend/repositories"
+
+	_ "modernc.org/sqlite"
+	"xorm.io/xorm"
+)
+
+// newTestEngine 创建使用临时SQLite文件的数据库引擎并同步表结构
+func newTestEngine(t *testing.T) *xorm.Engine {
+	t.Helper()
+	engine, err := xorm.NewEngine("sqlite", filepath.Join(t.TempDir(), "test.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	if err := engine.Sync2(new(models.Job), new(models.JobTransition), new(models.JobBatch), new(models.WebhookDelivery)); err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+// fakeVideoProvider 测试用的视频生成服务，记录提交的任务，可以阻塞提交或返回错误
+type fakeVideoProvider struct {
+	mu        sync.Mutex
+	submitted []string      // 按提交顺序记录的提示词
+	err       error         // 不为nil时提交返回该错误
+	block     chan struct{} // 不为nil时提交阻塞到通道关闭
+	statusErr error         // 不为nil时查询返回该错误
+}
+
+func (p *fakeVideoProvider) Name() string {
+	return "Fake"
+}
+
+func (p *fakeVideoProvider) Submit(ctx context.Context, req providers.SubmitRequest) (*providers.SubmitResult, error) {
+	p.mu.Lock()
+	p.submitted = append(p.submitted, req.Prompt)
+	err, block := p.err, p.block
+	p.mu.Unlock()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &providers.SubmitResult{TaskID: "upstream-" + req.Prompt}, nil
+}
+
+func (p *fakeVideoProvider) Status(ctx context.Context, taskID string) (*providers.StatusResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.statusErr != nil {
+		return nil, p.statusErr
+	}
+	return &providers.StatusResult{Status: providers.TaskRunning}, nil
+}
+
+func (p *fakeVideoProvider) Cancel(ctx context.Context, taskID string) error {
+	return nil
+}
+
+func (p *fakeVideoProvider) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// submittedPrompts 已提交的提示词
+func (p *fakeVideoProvider) submittedPrompts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.submitted...)
+}
+
+// faultyJobRepository 可以让指定的更新返回数据库错误的任务仓库
+type faultyJobRepository struct {
+	repositories.JobRepository
+
+	mu       sync.Mutex
+	failWhen func(job *models.Job) bool
+}
+
+func (r *faultyJobRepository) UpdateIfStatus(job *models.Job, statuses ...string) (bool, error) {
+	r.mu.Lock()
+	failWhen := r.failWhen
+	r.mu.Unlock()
+	if failWhen != nil && failWhen(job) {
+		return false, errors.New("database is locked")
+	}
+	return r.JobRepository.UpdateIfStatus(job, statuses...)
+}
+
+// schedulerFixture 按app.go的方式组装调度器：任务写入后发布事件，调度器监听事件更新名额
+type schedulerFixture struct {
+	jobRepo   repositories.JobRepository
+	faulty    *faultyJobRepository
+	provider  *fakeVideoProvider
+	scheduler *jobSchedulerImpl
+}
+
+func newSchedulerFixture(t *testing.T, maxConcurrent, maxPerUser int) *schedulerFixture {
+	t.Helper()
+	broker := NewJobEventBroker()
+	faulty := &faultyJobRepository{JobRepository: repositories.NewXormJobRepository(newTestEngine(t))}
+	jobRepo := NewPublishingJobRepository(faulty, broker)
+	provider := &fakeVideoProvider{}
+	scheduler := NewJobScheduler(jobRepo, provider, NewJobCanceler()).(*jobSchedulerImpl)
+	scheduler.maxConcurrent = maxConcurrent
+	scheduler.maxPerUser = maxPerUser
+	broker.AddListener(scheduler.Observe)
+	return &schedulerFixture{jobRepo: jobRepo, faulty: faulty, provider: provider, scheduler: scheduler}
+}
+
+// failSaves 让满足条件的任务更新返回数据库错误
+func (f *schedulerFixture) failSaves(failWhen func(job *models.Job) bool) {
+	f.faulty.mu.Lock()
+	defer f.faulty.mu.Unlock()
+	f.faulty.failWhen = failWhen
+}
+
+// queued 排队中的任务数
+func (f *schedulerFixture) queued() int {
+	f.scheduler.mu.Lock()
+	defer f.scheduler.mu.Unlock()
+	n := 0
+	for _, queue := range f.scheduler.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// inFlight 占用名额的任务数
+func (f *schedulerFixture) inFlight() int {
+	f.scheduler.mu.Lock()
+	defer f.scheduler.mu.Unlock()
+	return len(f.scheduler.inFlight)
+}
+
+// enqueue 创建PENDING任务并加入队列，提示词用作任务和上游任务的标识
+func (f *schedulerFixture) enqueue(t *testing.T, userID int64, prompt string) *models.Job {
+	t.Helper()
+	job := &models.Job{
+		JobID:  "job_" + prompt,
+		UserID: userID,
+		Type:   "text_to_video",
+		Prompt: prompt,
+		Status: models.TaskPending,
+	}
+	if err := f.jobRepo.Create(job); err != nil {
+		t.Fatal(err)
+	}
+	f.scheduler.Enqueue(job)
+	return job
+}
+
+// reload 读取任务的最新状态
+func (f *schedulerFixture) reload(t *testing.T, job *models.Job) *models.Job {
+	t.Helper()
+	latest, err := f.jobRepo.FindByJobIDForUser(job.JobID, job.UserID)
+	if err != nil || latest == nil {
+		t.Fatalf("reload %s: %v", job.JobID, err)
+	}
+	return latest
+}
+
+// waitFor 等待条件成立，超时时测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJobSchedulerPostponesWhileCircuitOpen(t *testing.T) {
+	f := newSchedulerFixture(t, 2, 2)
+	// 熔断的结束由测试控制
+	f.scheduler.circuitDelay = time.Hour
+	f.provider.setErr(fmt.Errorf("%w: Fake is unavailable", providers.ErrCircuitOpen))
+	f.scheduler.Start()
+	defer f.scheduler.Stop()
+
+	var jobs []*models.Job
+	for i := 0; i < 10; i++ {
+		jobs = append(jobs, f.enqueue(t, 1, fmt.Sprintf("p%d", i)))
+	}
+
+	// 熔断期间只会尝试提交占用名额的任务，任务回到队列而不是全部失败
+	time.Sleep(100 * time.Millisecond)
+	attempts := len(f.provider.submittedPrompts())
+	if attempts == 0 || attempts > 2 {
+		t.Fatalf("submit attempts while the breaker is open = %d, want 1 or 2", attempts)
+	}
+	for _, job := range jobs {
+		if status := f.reload(t, job).Status; status != models.TaskPending {
+			t.Fatalf("job %s status = %s while the breaker is open, want PENDING", job.JobID, status)
+		}
+	}
+
+	// 熔断结束后队列继续提交，所有任务都得到上游任务ID
+	f.provider.setErr(nil)
+	f.scheduler.mu.Lock()
+	f.scheduler.maxConcurrent, f.scheduler.maxPerUser = len(jobs), len(jobs)
+	f.scheduler.pausedUntil = time.Time{}
+	f.scheduler.mu.Unlock()
+	f.scheduler.signal()
+	waitFor(t, "all jobs submitted", func() bool {
+		for _, job := range jobs {
+			if f.reload(t, job).UpstreamTaskID == "" {
+				return false
+			}
+		}
+		return true
+	})
+	prompts := f.provider.submittedPrompts()
+	if len(prompts) != attempts+len(jobs) {
+		t.Errorf("submit calls = %d, want %d", len(prompts), attempts+len(jobs))
+	}
+}
+
+func TestJobSchedulerPostponesWhenUpstreamAsksToWait(t *testing.T) {
+	f := newSchedulerFixture(t, 2, 2)
+	f.provider.setErr(&providers.RetryAfterError{Name: "Fake", Wait: time.Hour})
+	f.scheduler.Start()
+	defer f.scheduler.Stop()
+
+	job := f.enqueue(t, 1, "a")
+	waitFor(t, "the job to be put back in the queue", func() bool {
+		return len(f.provider.submittedPrompts()) == 1 && f.queued() == 1 && f.inFlight() == 0
+	})
+
+	// 任务保持PENDING，按上游要求的时间暂停提交，提交的goroutine不会等待
+	if latest := f.reload(t, job); latest.Status != models.TaskPending || latest.Error != "" {
+		t.Errorf("job: status %s, error %q, want PENDING", latest.Status, latest.Error)
+	}
+	f.scheduler.mu.Lock()
+	paused := time.Until(f.scheduler.pausedUntil)
+	f.scheduler.mu.Unlock()
+	if paused < 59*time.Minute {
+		t.Errorf("submissions paused for %s, want about 1h", paused)
+	}
+}
+
+func TestJobSchedulerReleasesSlotWhenSaveFails(t *testing.T) {
+	tests := []struct {
+		name      string
+		submitErr error
+		failWhen  func(job *models.Job) bool
+	}{
+		{
+			name: "saving upstream task ID",
+			failWhen: func(job *models.Job) bool {
+				return job.JobID == "job_first" && job.UpstreamTaskID != ""
+			},
+		},
+		{
+			name:      "saving submit failure",
+			submitErr: errors.New("invalid parameter"),
+			failWhen: func(job *models.Job) bool {
+				return job.JobID == "job_first" && job.Status == models.TaskFailed
+			},
+		},
+		{
+			name: "saving running status",
+			failWhen: func(job *models.Job) bool {
+				return job.JobID == "job_first" && job.Status == models.TaskRunning
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newSchedulerFixture(t, 1, 1)
+			f.provider.setErr(tt.submitErr)
+			f.failSaves(tt.failWhen)
+			f.scheduler.Start()
+			defer f.scheduler.Stop()
+
+			// 只有一个名额，第一个任务保存失败后名额必须归还，第二个任务才能提交
+			f.enqueue(t, 1, "first")
+			waitFor(t, "first job to release its slot", func() bool { return f.queued() == 0 && f.inFlight() == 0 })
+			f.provider.setErr(nil)
+			second := f.enqueue(t, 1, "second")
+			waitFor(t, "second job submitted", func() bool { return f.reload(t, second).UpstreamTaskID != "" })
+		})
+	}
+}
+
+// queuedJob 只用于调度顺序测试的排队任务，不写入数据库
+func queuedJob(userID int64, jobID string) *models.Job {
+	return &models.Job{JobID: jobID, UserID: userID, Status: models.TaskPending}
+}
+
+// dequeueAll 取出当前可以派发的所有任务
+func dequeueAll(s *jobSchedulerImpl) []string {
+	var jobIDs []string
+	for job := s.dequeue(); job != nil; job = s.dequeue() {
+		jobIDs = append(jobIDs, job.JobID)
+	}
+	return jobIDs
+}
+
+func TestJobSchedulerRoundRobinAcrossUsers(t *testing.T) {
+	f := newSchedulerFixture(t, 10, 10)
+	s := f.scheduler
+	for _, jobID := range []string{"a1", "a2", "a3", "a4"} {
+		s.Enqueue(queuedJob(1, jobID))
+	}
+	s.Enqueue(queuedJob(2, "b1"))
+	s.Enqueue(queuedJob(2, "b2"))
+	s.Enqueue(queuedJob(3, "c1"))
+
+	// 先入队很多任务的用户不会让后来的用户一直等待
+	got := dequeueAll(s)
+	want := []string{"a1", "b1", "c1", "a2", "b2", "a3", "a4"}
+	if !slices.Equal(got, want) {
+		t.Errorf("dispatch order = %v, want %v", got, want)
+	}
+}
+
+func TestJobSchedulerPerUserLimit(t *testing.T) {
+	f := newSchedulerFixture(t, 10, 2)
+	s := f.scheduler
+	for _, jobID := range []string{"a1", "a2", "a3", "a4"} {
+		s.Enqueue(queuedJob(1, jobID))
+	}
+	s.Enqueue(queuedJob(2, "b1"))
+
+	if got, want := dequeueAll(s), []string{"a1", "b1", "a2"}; !slices.Equal(got, want) {
+		t.Fatalf("dispatched = %v, want %v (user 1 is limited to 2 jobs)", got, want)
+	}
+
+	// 用户的任务结束后才能派发该用户的下一个任务
+	s.Observe(models.Job{JobID: "b1", UserID: 2, Status: models.TaskSucceeded})
+	if got := dequeueAll(s); len(got) != 0 {
+		t.Fatalf("dispatched %v after another user's job finished, want none", got)
+	}
+	s.Observe(models.Job{JobID: "a1", UserID: 1, Status: models.TaskFailed})
+	if got, want := dequeueAll(s), []string{"a3"}; !slices.Equal(got, want) {
+		t.Fatalf("dispatched = %v, want %v", got, want)
+	}
+}
+
+func TestJobSchedulerGlobalLimit(t *testing.T) {
+	f := newSchedulerFixture(t, 2, 2)
+	s := f.scheduler
+	s.Enqueue(queuedJob(1, "a1"))
+	s.Enqueue(queuedJob(1, "a2"))
+	s.Enqueue(queuedJob(2, "b1"))
+	s.Enqueue(queuedJob(3, "c1"))
+
+	if got, want := dequeueAll(s), []string{"a1", "b1"}; !slices.Equal(got, want) {
+		t.Fatalf("dispatched = %v, want %v", got, want)
+	}
+
+	// 已提交并在上游排队的任务仍占用名额，只有没有上游任务ID的PENDING任务归还名额
+	s.Observe(models.Job{JobID: "a1", UserID: 1, Status: models.TaskPending, UpstreamTaskID: "upstream-a1"})
+	if got := dequeueAll(s); len(got) != 0 {
+		t.Fatalf("dispatched %v while all slots are used, want none", got)
+	}
+	s.Observe(models.Job{JobID: "b1", UserID: 2, Status: models.TaskPending})
+	if got, want := dequeueAll(s), []string{"c1"}; !slices.Equal(got, want) {
+		t.Fatalf("dispatched = %v, want %v", got, want)
+	}
+}
+
+func TestJobSchedulerDropsJobsCanceledWhileQueued(t *testing.T) {
+	f := newSchedulerFixture(t, 10, 10)
+	s := f.scheduler
+	s.Enqueue(queuedJob(1, "a1"))
+	s.Enqueue(queuedJob(1, "a2"))
+	s.Enqueue(queuedJob(2, "b1"))
+
+	s.Observe(models.Job{JobID: "a1", UserID: 1, Status: models.TaskCanceled})
+	if got, want := dequeueAll(s), []string{"a2", "b1"}; !slices.Equal(got, want) {
+		t.Errorf("dispatched = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,403 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"emoji-maker-backend/config"
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/providers"
+	"emoji-maker-backend/repositories"
+)
+
+// JobWorker 后台任务轮询器接口
+type JobWorker interface {
+	Start()
+	Stop()
+}
+
+// jobWorkerImpl 定时轮询视频生成服务并将完成的视频转换为GIF
+type jobWorkerImpl struct {
+	jobRepo     repositories.JobRepository
+	usageRepo   repositories.UsageRepository
+	provider    providers.VideoProvider
+	catalog     ModelCatalog
+	canceler    JobCanceler
+	interval    time.Duration
+	concurrency int
+	maxFailures int // 连续查询上游状态失败的次数上限
+
+	queue chan *models.Job
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	mu         sync.Mutex
+	processing map[string]bool // 正在处理中的任务，避免同一任务被重复派发和重复转换
+}
+
+// NewJobWorker 创建后台任务轮询器实例
+func NewJobWorker(jobRepo repositories.JobRepository, usageRepo repositories.UsageRepository, provider providers.VideoProvider, catalog ModelCatalog, canceler JobCanceler) JobWorker {
+	return &jobWorkerImpl{
+		jobRepo:     jobRepo,
+		usageRepo:   usageRepo,
+		provider:    provider,
+		catalog:     catalog,
+		canceler:    canceler,
+		interval:    config.AppConfig.Worker.PollInterval,
+		concurrency: config.AppConfig.Worker.Concurrency,
+		maxFailures: config.AppConfig.Worker.MaxPollFailures,
+		queue:       make(chan *models.Job),
+		stop:        make(chan struct{}),
+		processing:  make(map[string]bool),
+	}
+}
+
+// Start 启动调度协程和工作协程池
+func (w *jobWorkerImpl) Start() {
+	for i := 0; i < w.concurrency; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+
+	w.wg.Add(1)
+	go w.schedule()
+}
+
+// Stop 停止轮询并等待进行中的任务处理完毕
+func (w *jobWorkerImpl) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// schedule 按固定间隔扫描未完成的任务并派发给工作协程
+func (w *jobWorkerImpl) schedule() {
+	defer w.wg.Done()
+	defer close(w.queue)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		jobs, err := w.jobRepo.FindActive()
+		if err != nil {
+			log.Printf("扫描未完成任务失败: %v", err)
+			continue
+		}
+
+		for _, job := range jobs {
+			if !w.claim(job.JobID) {
+				continue
+			}
+			select {
+			case w.queue <- job:
+			case <-w.stop:
+				w.release(job.JobID)
+				return
+			}
+		}
+	}
+}
+
+// work 工作协程，逐个处理派发过来的任务
+func (w *jobWorkerImpl) work() {
+	defer w.wg.Done()
+	for job := range w.queue {
+		w.process(job)
+		w.release(job.JobID)
+	}
+}
+
+// claim 标记任务为处理中，已在处理中则返回false
+func (w *jobWorkerImpl) claim(jobID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.processing[jobID] {
+		return false
+	}
+	w.processing[jobID] = true
+	return true
+}
+
+// release 取消任务的处理中标记
+func (w *jobWorkerImpl) release(jobID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.processing, jobID)
+}
+
+// process 推进单个任务：查询上游任务状态，成功后转换GIF
+func (w *jobWorkerImpl) process(job *models.Job) {
+	// 登记本地工作，任务被取消时中止查询和转换
+	ctx, done := w.canceler.Track(job.JobID)
+	defer done()
+
+	if job.Status != models.TaskConverting {
+		status, err := w.provider.Status(ctx, job.UpstreamTaskID)
+		var retryAfter *providers.RetryAfterError
+		if errors.Is(err, providers.ErrCircuitOpen) || errors.As(err, &retryAfter) {
+			// 上游暂时不可用或限流时任务本身可能仍在进行，保持当前状态，之后的轮询再查询
+			return
+		}
+		if errors.Is(err, providers.ErrTaskNotFound) {
+			// 上游已经没有这个任务，重试时需要重新提交，按生成失败处理
+			w.fail(job, models.JobStepGenerate, err.Error())
+			return
+		}
+		if err != nil {
+			w.pollFailed(job, err)
+			return
+		}
+		job.PollFailures = 0
+
+		// 更新本地任务状态
+		name := w.provider.Name()
+		var usage *models.UsageRecord
+		switch status.Status {
+		case providers.TaskPending:
+			err = job.TransitionTo(models.TaskPending, models.JobStepQuery, name+"任务排队中")
+		case providers.TaskRunning:
+			err = job.TransitionTo(models.TaskRunning, models.JobStepQuery, name+"任务运行中")
+		case providers.TaskSucceeded:
+			err = job.TransitionTo(models.TaskConverting, models.JobStepQuery, name+"视频生成完成")
+			job.VideoURL = status.VideoURL
+			job.VideoExpiresAt = status.VideoExpiresAt
+			job.OrigPrompt = status.OrigPrompt
+			job.ActualPrompt = status.ActualPrompt
+			usage = w.videoUsage(job, status.Usage)
+			job.VideoSeconds += usage.VideoSeconds
+			job.Cost += usage.Cost
+		default:
+			// 生成失败或已在上游取消，原因由服务给出
+			w.fail(job, models.JobStepGenerate, status.Message)
+			return
+		}
+		if err != nil {
+			log.Printf("任务 %s 状态更新失败: %v", job.JobID, err)
+			return
+		}
+		if !w.save(job) {
+			return
+		}
+		if usage != nil {
+			// 只在本次写入了上游生成完成的状态时记录，上游任务的用量不会重复计算
+			if err := w.usageRepo.Create(usage); err != nil {
+				log.Printf("记录任务 %s 的用量失败: %v", job.JobID, err)
+			}
+		}
+	}
+
+	if job.Status != models.TaskConverting {
+		return
+	}
+
+	result := downloadAndConvert(ctx, job)
+	if result.err != nil {
+		w.fail(job, result.step, result.err.Error())
+		return
+	}
+	if err := job.TransitionTo(models.TaskSucceeded, models.JobStepConvert, "GIF转换完成"); err != nil {
+		log.Printf("任务 %s 状态更新失败: %v", job.JobID, err)
+		os.Remove(result.outputPath)
+		return
+	}
+	job.OutputPath = result.outputPath
+	job.OutputURL = result.outputURL
+	job.FinishedAt = time.Now()
+	if !w.save(job) {
+		// 任务在转换期间已被取消，丢弃生成的GIF
+		os.Remove(result.outputPath)
+	}
+}
+
+// videoUsage 根据上游返回的用量和模型价格生成视频用量记录
+func (w *jobWorkerImpl) videoUsage(job *models.Job, usage providers.Usage) *models.UsageRecord {
+	count := usage.VideoCount
+	if count == 0 {
+		count = 1
+	}
+	seconds := usage.Duration * count
+	return &models.UsageRecord{
+		UserID:         job.UserID,
+		JobID:          job.JobID,
+		Kind:           models.UsageKindVideo,
+		Model:          job.Model,
+		UpstreamTaskID: job.UpstreamTaskID,
+		VideoSeconds:   seconds,
+		VideoCount:     count,
+		VideoSR:        usage.SR,
+		VideoRatio:     usage.VideoRatio,
+		Cost:           w.catalog.VideoCost(job.Model, seconds),
+	}
+}
+
+// conversionResult 一次下载和转换的结果
+type conversionResult struct {
+	outputPath string
+	outputURL  string
+	step       string // 失败的步骤
+	err        error
+}
+
+// downloadAndConvert 下载生成的视频并转换为GIF，下载和转换各有超时时间，卡住的任务不会一直占用工作协程
+func downloadAndConvert(ctx context.Context, job *models.Job) conversionResult {
+	os.MkdirAll("tasks", 0755)
+	cfg := config.AppConfig.Worker
+
+	// 1. 下载视频文件
+	videoPath := fmt.Sprintf("tasks/%s.mp4", job.JobID)
+	// 清理临时视频文件
+	defer os.Remove(videoPath)
+	downloadCtx, cancel := context.WithTimeout(ctx, cfg.DownloadTimeout)
+	err := downloadFile(downloadCtx, job.VideoURL, videoPath)
+	if err != nil && errors.Is(downloadCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("Failed to download video: timed out after %s", cfg.DownloadTimeout)
+	}
+	cancel()
+	if err != nil {
+		return conversionResult{step: models.JobStepDownload, err: err}
+	}
+
+	// 2. 本地转换为标准GIF
+	convertCtx, cancel := context.WithTimeout(ctx, cfg.ConvertTimeout)
+	defer cancel()
+	outputPath, outputURL, err := convertVideoToGif(convertCtx, job.JobID, videoPath)
+	if err != nil && errors.Is(convertCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("Failed to convert video to GIF: timed out after %s", cfg.ConvertTimeout)
+	}
+	if err != nil {
+		return conversionResult{step: models.JobStepConvert, err: err}
+	}
+	return conversionResult{outputPath: outputPath, outputURL: outputURL}
+}
+
+// save 持久化任务，任务已进入终态(例如被取消)或保存失败时返回false
+func (w *jobWorkerImpl) save(job *models.Job) bool {
+	updated, err := w.jobRepo.UpdateIfActive(job)
+	if err != nil {
+		log.Printf("保存任务 %s 失败: %v", job.JobID, err)
+		return false
+	}
+	return updated
+}
+
+// pollFailed 处理查询上游任务状态的错误
+// 网络错误和上游5xx等临时错误时上游任务可能仍在进行，保持任务状态等下次轮询再查，
+// 上游明确拒绝查询或连续失败次数达到上限时才将任务标记为失败
+func (w *jobWorkerImpl) pollFailed(job *models.Job, err error) {
+	job.PollFailures++
+	if !isDefinitiveStatusError(err) && job.PollFailures < w.maxFailures {
+		log.Printf("查询任务 %s 的上游状态失败(连续第%d次)，下次轮询时重试: %v", job.JobID, job.PollFailures, err)
+		w.save(job)
+		return
+	}
+	w.fail(job, models.JobStepQuery, err.Error())
+}
+
+// isDefinitiveStatusError 上游是否明确拒绝了查询请求，例如鉴权失败或参数错误，重试也不会成功
+func isDefinitiveStatusError(err error) bool {
+	var upstreamErr *providers.Error
+	if !errors.As(err, &upstreamErr) {
+		return false
+	}
+	status := upstreamErr.StatusCode
+	return status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// fail 将任务标记为失败并记录失败的步骤和错误
+func (w *jobWorkerImpl) fail(job *models.Job, step, errMsg string) {
+	if err := job.Fail(step, errMsg); err != nil {
+		log.Printf("任务 %s 标记失败时出错: %v", job.JobID, err)
+		return
+	}
+	w.save(job)
+}
+
+// convertVideoToGif 将下载好的视频本地转换为标准GIF(适合微信发送的尺寸)，返回GIF的本地路径和访问地址
+// GIF通过/tasks公开访问，因此文件名使用随机生成的名字，泄露任务ID也无法据此拿到GIF
+func convertVideoToGif(ctx context.Context, jobID, videoPath string) (string, string, error) {
+	gifName, err := randomFileName(".gif")
+	if err != nil {
+		return "", "", err
+	}
+	gifPath := "tasks/" + gifName
+	// 使用两步法优化GIF，保持原始宽高比:
+	// 第一步: 生成调色板
+	palettePath := fmt.Sprintf("tasks/%s_palette.png", jobID)
+	// 清理调色板文件
+	defer os.Remove(palettePath)
+	paletteCmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", videoPath, "-vf", "scale=240:240:force_original_aspect_ratio=decrease,pad=240:240:(ow-iw)/2:(oh-ih)/2:color=black@0,palettegen", palettePath)
+	if output, err := paletteCmd.CombinedOutput(); err != nil {
+		log.Printf("调色板生成失败: %v %s", err, string(output))
+		return "", "", fmt.Errorf("Failed to generate palette: %v", err)
+	}
+
+	// 第二步: 使用调色板生成优化的GIF，保持原始宽高比
+	// 先写入临时文件再重命名，GIF目录中不会出现写了一半的文件
+	partPath := gifPath + ".part"
+	defer os.Remove(partPath)
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", videoPath, "-i", palettePath, "-lavfi", "scale=240:240:force_original_aspect_ratio=decrease,pad=240:240:(ow-iw)/2:(oh-ih)/2:color=black@0,fps=8 [x]; [x][1:v] paletteuse", "-f", "gif", partPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("ffmpeg转换失败: %v %s", err, string(output))
+		return "", "", fmt.Errorf("Failed to convert video to GIF: %v", err)
+	}
+	if err := os.Rename(partPath, gifPath); err != nil {
+		return "", "", fmt.Errorf("Failed to save GIF: %v", err)
+	}
+
+	return gifPath, "https://" + config.AppConfig.Server.Host + ":" + config.AppConfig.Server.Port + "/tasks/" + gifName, nil
+}
+
+// randomFileName 生成不可猜测的随机文件名
+func randomFileName(ext string) (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes) + ext, nil
+}
+
+// downloadFile 下载远程文件到本地路径
+func downloadFile(ctx context.Context, url, path string) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to download video: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("Failed to download video: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to download video: unexpected status %s", resp.Status)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Failed to create video file: %v", err)
+	}
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return fmt.Errorf("Failed to save video file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("Failed to save video file: %v", err)
+	}
+	return nil
+}
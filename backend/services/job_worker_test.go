@@ -0,0 +1,136 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/providers"
+	"emoji-maker-backend/repositories"
+)
+
+// newTestWorker 创建不启动轮询的后台任务轮询器，测试直接调用process
+func newTestWorker(t *testing.T, provider providers.VideoProvider) (*jobWorkerImpl, repositories.JobRepository) {
+	t.Helper()
+	jobRepo := repositories.NewXormJobRepository(newTestEngine(t))
+	worker := NewJobWorker(jobRepo, nil, provider, nil, NewJobCanceler()).(*jobWorkerImpl)
+	return worker, jobRepo
+}
+
+// createRunningJob 创建已提交到上游、正在生成的任务
+func createRunningJob(t *testing.T, jobRepo repositories.JobRepository) *models.Job {
+	t.Helper()
+	job := &models.Job{JobID: "job_running", UserID: 1, Status: models.TaskRunning, UpstreamTaskID: "upstream-running"}
+	if err := jobRepo.Create(job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestJobWorkerKeepsJobWhileCircuitOpen(t *testing.T) {
+	provider := &fakeVideoProvider{statusErr: fmt.Errorf("Failed to query task status: %w", providers.ErrCircuitOpen)}
+	worker, jobRepo := newTestWorker(t, provider)
+	job := createRunningJob(t, jobRepo)
+
+	worker.process(job)
+
+	latest, err := jobRepo.FindByJobIDForUser(job.JobID, job.UserID)
+	if err != nil || latest == nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if latest.Status != models.TaskRunning || latest.Error != "" {
+		t.Errorf("job after a poll during an upstream outage: status %s, error %q, want RUNNING", latest.Status, latest.Error)
+	}
+}
+
+func TestJobWorkerPollFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus []string // 每次轮询后的状态
+	}{
+		{
+			name:       "temporary error",
+			err:        errors.New("Failed to query task status: connection reset by peer"),
+			wantStatus: []string{models.TaskRunning, models.TaskRunning, models.TaskFailed},
+		},
+		{
+			name:       "upstream 5xx",
+			err:        &providers.Error{StatusCode: http.StatusInternalServerError, Code: "InternalError"},
+			wantStatus: []string{models.TaskRunning, models.TaskRunning, models.TaskFailed},
+		},
+		{
+			name:       "rejected by upstream",
+			err:        &providers.Error{StatusCode: http.StatusUnauthorized, Code: "InvalidApiKey"},
+			wantStatus: []string{models.TaskFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeVideoProvider{statusErr: tt.err}
+			worker, jobRepo := newTestWorker(t, provider)
+			worker.maxFailures = 3
+			job := createRunningJob(t, jobRepo)
+
+			for i, want := range tt.wantStatus {
+				latest, err := jobRepo.FindByJobIDForUser(job.JobID, job.UserID)
+				if err != nil || latest == nil {
+					t.Fatalf("reload: %v", err)
+				}
+				worker.process(latest)
+
+				latest, _ = jobRepo.FindByJobIDForUser(job.JobID, job.UserID)
+				if latest.Status != want {
+					t.Fatalf("status after poll %d = %s, want %s", i+1, latest.Status, want)
+				}
+				if want == models.TaskFailed && latest.FailedStep != models.JobStepQuery {
+					t.Errorf("failed step = %s, want %s", latest.FailedStep, models.JobStepQuery)
+				}
+			}
+		})
+	}
+}
+
+func TestJobWorkerResetsPollFailures(t *testing.T) {
+	provider := &fakeVideoProvider{statusErr: errors.New("connection reset by peer")}
+	worker, jobRepo := newTestWorker(t, provider)
+	worker.maxFailures = 2
+	job := createRunningJob(t, jobRepo)
+
+	worker.process(job)
+	provider.mu.Lock()
+	provider.statusErr = nil
+	provider.mu.Unlock()
+	job, _ = jobRepo.FindByJobIDForUser(job.JobID, job.UserID)
+	worker.process(job)
+
+	// 查询成功后重新计数，之后的一次失败不会让任务失败
+	provider.mu.Lock()
+	provider.statusErr = errors.New("connection reset by peer")
+	provider.mu.Unlock()
+	job, _ = jobRepo.FindByJobIDForUser(job.JobID, job.UserID)
+	if job.PollFailures != 0 {
+		t.Fatalf("poll failures after a successful poll = %d, want 0", job.PollFailures)
+	}
+	worker.process(job)
+	job, _ = jobRepo.FindByJobIDForUser(job.JobID, job.UserID)
+	if job.Status != models.TaskRunning {
+		t.Errorf("status = %s, want %s", job.Status, models.TaskRunning)
+	}
+}
+
+func TestJobWorkerFailsUnknownTaskAtGenerateStep(t *testing.T) {
+	provider := &fakeVideoProvider{statusErr: fmt.Errorf("%w: local task upstream-running", providers.ErrTaskNotFound)}
+	worker, jobRepo := newTestWorker(t, provider)
+	job := createRunningJob(t, jobRepo)
+
+	worker.process(job)
+
+	// 按生成失败记录，重试时会重新提交而不是继续查询已不存在的上游任务
+	latest, _ := jobRepo.FindByJobIDForUser(job.JobID, job.UserID)
+	if latest.Status != models.TaskFailed || latest.FailedStep != models.JobStepGenerate {
+		t.Errorf("job: status %s, failed step %s, want FAILED at %s", latest.Status, latest.FailedStep, models.JobStepGenerate)
+	}
+}
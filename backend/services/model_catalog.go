@@ -0,0 +1,125 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+
+	"emoji-maker-backend/config"
+)
+
+// 视频模型的生成方式
+const (
+	CapabilityTextToVideo  = "t2v"
+	CapabilityImageToVideo = "i2v"
+)
+
+// ModelCatalog 可用模型目录，模型及其能力来自配置中的models部分
+type ModelCatalog interface {
+	VideoModels() []config.VideoModel
+	TextModels() []config.TextModel
+	// ResolveVideoModel 查找支持指定生成方式的视频模型，name为空时返回该生成方式的默认模型
+	ResolveVideoModel(name, capability string) (*config.VideoModel, error)
+	// ResolveTextModel 查找文本模型，name为空时返回默认模型
+	ResolveTextModel(name string) (*config.TextModel, error)
+	// VideoCost 按模型价格估算生成视频的费用(元)，模型已不在目录中时返回0
+	VideoCost(model string, seconds int) float64
+	// TextCost 按模型价格估算文本模型的费用(元)，模型已不在目录中时返回0
+	TextCost(model string, tokens int) float64
+}
+
+// modelCatalogImpl 模型目录实现
+type modelCatalogImpl struct {
+	video []config.VideoModel
+	text  []config.TextModel
+}
+
+// NewModelCatalog 根据配置创建模型目录实例
+func NewModelCatalog() ModelCatalog {
+	return &modelCatalogImpl{
+		video: config.AppConfig.Models.Video,
+		text:  config.AppConfig.Models.Text,
+	}
+}
+
+// VideoModels 返回所有视频模型
+func (m *modelCatalogImpl) VideoModels() []config.VideoModel {
+	return m.video
+}
+
+// TextModels 返回所有文本模型
+func (m *modelCatalogImpl) TextModels() []config.TextModel {
+	return m.text
+}
+
+// ResolveVideoModel 查找视频模型，没有标记为默认的模型时使用第一个支持该生成方式的模型
+func (m *modelCatalogImpl) ResolveVideoModel(name, capability string) (*config.VideoModel, error) {
+	var fallback *config.VideoModel
+	for i := range m.video {
+		model := &m.video[i]
+		if name != "" {
+			if model.Name != name {
+				continue
+			}
+			if !slices.Contains(model.Capabilities, capability) {
+				return nil, fmt.Errorf("Model %s does not support %s", name, capability)
+			}
+			return model, nil
+		}
+
+		if !slices.Contains(model.Capabilities, capability) {
+			continue
+		}
+		if model.Default {
+			return model, nil
+		}
+		if fallback == nil {
+			fallback = model
+		}
+	}
+
+	if name != "" {
+		return nil, fmt.Errorf("Unknown model: %s", name)
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("No model available for %s", capability)
+	}
+	return fallback, nil
+}
+
+// ResolveTextModel 查找文本模型，没有标记为默认的模型时使用第一个模型
+func (m *modelCatalogImpl) ResolveTextModel(name string) (*config.TextModel, error) {
+	for i := range m.text {
+		model := &m.text[i]
+		if model.Name == name || (name == "" && model.Default) {
+			return model, nil
+		}
+	}
+
+	if name != "" {
+		return nil, fmt.Errorf("Unknown text model: %s", name)
+	}
+	if len(m.text) == 0 {
+		return nil, fmt.Errorf("No text model available")
+	}
+	return &m.text[0], nil
+}
+
+// VideoCost 估算视频费用
+func (m *modelCatalogImpl) VideoCost(model string, seconds int) float64 {
+	for _, video := range m.video {
+		if video.Name == model {
+			return float64(seconds) * video.CostPerSecond
+		}
+	}
+	return 0
+}
+
+// TextCost 估算文本模型费用
+func (m *modelCatalogImpl) TextCost(model string, tokens int) float64 {
+	for _, text := range m.text {
+		if text.Name == model {
+			return float64(tokens) / 1000 * text.CostPer1KTokens
+		}
+	}
+	return 0
+}
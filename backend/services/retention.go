@@ -0,0 +1,304 @@
+package services
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"emoji-maker-backend/config"
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/repositories"
+)
+
+// retentionBatchSize 每次从数据库取出的待清理任务数
+const retentionBatchSize = 100
+
+// RetentionService 任务产物的定期清理服务接口
+type RetentionService interface {
+	Start()
+	Stop()
+	// RunOnce 立即执行一轮清理
+	RunOnce()
+}
+
+// retentionServiceImpl 按最长保留时间、每用户任务上限和磁盘预算清理任务及其GIF和输入图片，并清扫转换中断遗留的临时文件
+type retentionServiceImpl struct {
+	jobRepo        repositories.JobRepository
+	dir            string
+	inputDir       string
+	interval       time.Duration
+	maxAge         time.Duration
+	maxJobsPerUser int
+	maxDiskBytes   int64
+	tempFileMaxAge time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRetentionService 创建清理服务实例
+func NewRetentionService(jobRepo repositories.JobRepository) RetentionService {
+	cfg := config.AppConfig.Retention
+	return &retentionServiceImpl{
+		jobRepo:        jobRepo,
+		dir:            "tasks",
+		inputDir:       config.AppConfig.Upload.Dir,
+		interval:       cfg.Interval,
+		maxAge:         cfg.MaxAge,
+		maxJobsPerUser: cfg.MaxJobsPerUser,
+		maxDiskBytes:   cfg.MaxDiskMB * 1024 * 1024,
+		tempFileMaxAge: cfg.TempFileMaxAge,
+		stop:           make(chan struct{}),
+	}
+}
+
+// Start 启动定期清理协程
+func (s *retentionServiceImpl) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			s.RunOnce()
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop 停止定期清理
+func (s *retentionServiceImpl) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// RunOnce 执行一轮清理，各项限制配置为0时表示不限制
+func (s *retentionServiceImpl) RunOnce() {
+	if s.maxAge > 0 {
+		s.removeExpired()
+	}
+	if s.maxJobsPerUser > 0 {
+		s.enforcePerUserCap()
+	}
+	s.sweepOrphans()
+	s.sweepInputImages()
+	if s.maxDiskBytes > 0 {
+		s.enforceDiskBudget()
+	}
+}
+
+// removeExpired 删除超过最长保留时间的已结束任务
+func (s *retentionServiceImpl) removeExpired() {
+	before := time.Now().Add(-s.maxAge)
+	for {
+		jobs, err := s.jobRepo.FindFinishedBefore(before, retentionBatchSize)
+		if err != nil {
+			log.Printf("查询过期任务失败: %v", err)
+			return
+		}
+		for _, job := range jobs {
+			if !s.removeJob(job) {
+				return
+			}
+		}
+		if len(jobs) < retentionBatchSize {
+			return
+		}
+	}
+}
+
+// enforcePerUserCap 每个用户只保留最新的若干个已结束任务
+func (s *retentionServiceImpl) enforcePerUserCap() {
+	userIDs, err := s.jobRepo.FindUserIDsOverLimit(s.maxJobsPerUser)
+	if err != nil {
+		log.Printf("查询超出任务上限的用户失败: %v", err)
+		return
+	}
+	for _, userID := range userIDs {
+		jobs, err := s.jobRepo.FindFinishedByUserBeyond(userID, s.maxJobsPerUser)
+		if err != nil {
+			log.Printf("查询用户 %d 的多余任务失败: %v", userID, err)
+			continue
+		}
+		for _, job := range jobs {
+			if !s.removeJob(job) {
+				return
+			}
+		}
+	}
+}
+
+// enforceDiskBudget 任务目录和输入图片目录合计超出磁盘预算时，从最旧的任务开始删除直到回到预算以内
+func (s *retentionServiceImpl) enforceDiskBudget() {
+	used := dirSize(s.dir) + dirSize(s.inputDir)
+	for used > s.maxDiskBytes {
+		jobs, err := s.jobRepo.FindFinishedWithOutput(retentionBatchSize)
+		if err != nil {
+			log.Printf("查询可清理的任务失败: %v", err)
+			return
+		}
+		if len(jobs) == 0 {
+			log.Printf("任务目录和输入图片目录占用 %d 字节，超出磁盘预算，但已没有可清理的任务", used)
+			return
+		}
+		for _, job := range jobs {
+			if info, err := os.Stat(job.OutputPath); err == nil {
+				used -= info.Size()
+			}
+			var inputSize int64
+			if job.InputImagePath != "" {
+				if info, err := os.Stat(job.InputImagePath); err == nil {
+					inputSize = info.Size()
+				}
+			}
+			if !s.removeJob(job) {
+				return
+			}
+			// 输入图片仍被同批次的其他任务引用时不会删除
+			if _, err := os.Stat(job.InputImagePath); inputSize > 0 && os.IsNotExist(err) {
+				used -= inputSize
+			}
+			if used <= s.maxDiskBytes {
+				return
+			}
+		}
+	}
+}
+
+// sweepOrphans 清扫任务目录中的遗留文件:
+//   - 转换中断遗留的临时视频、调色板和未写完的GIF，超过临时文件的保留时间后删除
+//   - 没有任务引用的GIF，包括任务迁移到数据库之前生成的GIF，与任务一样超过最长保留时间后删除
+//   - 旧版本保存任务数据的JSON文件，其中含有提示词和输入图片且可通过/tasks公开访问，任务已改为保存在数据库中，直接删除
+func (s *retentionServiceImpl) sweepOrphans() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取任务目录失败: %v", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		name := entry.Name()
+		path := filepath.Join(s.dir, name)
+		switch {
+		case strings.HasSuffix(name, ".json"):
+		case strings.HasSuffix(name, ".mp4"), strings.HasSuffix(name, "_palette.png"), strings.HasSuffix(name, ".gif.part"):
+			if info.ModTime().After(now.Add(-s.tempFileMaxAge)) {
+				// 最近修改过的文件可能属于正在进行的转换
+				continue
+			}
+		case strings.HasSuffix(name, ".gif"):
+			if s.maxAge <= 0 || info.ModTime().After(now.Add(-s.maxAge)) {
+				continue
+			}
+			referenced, err := s.jobRepo.ExistsByOutputPath(s.dir + "/" + name)
+			if err != nil || referenced {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Printf("删除遗留文件 %s 失败: %v", path, err)
+			continue
+		}
+		log.Printf("已删除遗留文件 %s", path)
+	}
+}
+
+// sweepInputImages 清扫没有任务引用的输入图片，例如创建任务失败时遗留的图片，以及未写完的临时文件
+func (s *retentionServiceImpl) sweepInputImages() {
+	entries, err := os.ReadDir(s.inputDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取输入图片目录失败: %v", err)
+		}
+		return
+	}
+
+	cutoff := time.Now().Add(-s.tempFileMaxAge)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			// 最近保存的图片可能属于正在创建的任务
+			continue
+		}
+
+		path := filepath.Join(s.inputDir, entry.Name())
+		if !strings.HasSuffix(path, ".part") {
+			referenced, err := s.jobRepo.ExistsByInputImagePath(path)
+			if err != nil || referenced {
+				continue
+			}
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Printf("删除遗留文件 %s 失败: %v", path, err)
+			continue
+		}
+		log.Printf("已删除遗留文件 %s", path)
+	}
+}
+
+// removeJob 删除任务的GIF和任务记录，出错时返回false以中止本轮清理，避免反复处理同一任务
+func (s *retentionServiceImpl) removeJob(job *models.Job) bool {
+	if job.OutputPath != "" {
+		if err := os.Remove(job.OutputPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("删除任务 %s 的GIF失败: %v", job.JobID, err)
+			return false
+		}
+	}
+	if err := s.jobRepo.Delete(job); err != nil {
+		log.Printf("删除任务 %s 失败: %v", job.JobID, err)
+		return false
+	}
+
+	// 批次中的任务共用输入图片，最后一个引用它的任务被删除时才删除图片
+	if job.InputImagePath != "" {
+		referenced, err := s.jobRepo.ExistsByInputImagePath(job.InputImagePath)
+		if err == nil && !referenced {
+			if err := os.Remove(job.InputImagePath); err != nil && !os.IsNotExist(err) {
+				log.Printf("删除任务 %s 的输入图片失败: %v", job.JobID, err)
+			}
+		}
+	}
+	return true
+}
+
+// dirSize 统计目录下文件的总大小
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
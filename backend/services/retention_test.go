@@ -0,0 +1,159 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/repositories"
+)
+
+func TestRetentionSweepOrphans(t *testing.T) {
+	jobRepo := repositories.NewXormJobRepository(newTestEngine(t))
+	dir := t.TempDir()
+	s := &retentionServiceImpl{
+		jobRepo:        jobRepo,
+		dir:            dir,
+		maxAge:         720 * time.Hour,
+		tempFileMaxAge: time.Hour,
+	}
+
+	now := time.Now()
+	files := map[string]struct {
+		age  time.Duration
+		kept bool
+	}{
+		"job_legacy.json":   {age: 0, kept: false},               // 旧版本的任务数据，无论新旧都删除
+		"job_legacy.gif":    {age: 2 * time.Hour, kept: true},    // 旧版本的GIF没有任务记录，按最长保留时间计算
+		"job_expired.gif":   {age: 800 * time.Hour, kept: false}, // 超过最长保留时间且没有任务引用
+		"referenced.gif":    {age: 800 * time.Hour, kept: true},  // 仍被任务引用，由任务的清理负责
+		"job_crashed.mp4":   {age: 2 * time.Hour, kept: false},   // 转换中断遗留
+		"job_running.mp4":   {age: time.Minute, kept: true},      // 可能正在转换
+		"job_a_palette.png": {age: 2 * time.Hour, kept: false},   // 转换中断遗留
+		"random.gif.part":   {age: 2 * time.Hour, kept: false},   // 未写完的GIF
+		"unrelated.txt":     {age: 1000 * time.Hour, kept: true}, // 不认识的文件不处理
+	}
+	for name, file := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(-file.age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := jobRepo.Create(&models.Job{JobID: "job_referenced", Status: models.TaskSucceeded, OutputPath: dir + "/referenced.gif"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.sweepOrphans()
+
+	for name, file := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != file.kept {
+			t.Errorf("%s exists = %v, want %v", name, exists, file.kept)
+		}
+	}
+}
+
+func TestRetentionRemoveJobDeletesRelatedRows(t *testing.T) {
+	engine := newTestEngine(t)
+	jobRepo := repositories.NewXormJobRepository(engine)
+	deliveryRepo := repositories.NewXormWebhookDeliveryRepository(engine)
+	s := &retentionServiceImpl{jobRepo: jobRepo}
+
+	job := &models.Job{JobID: "job_done", UserID: 1, Status: models.TaskSucceeded, CallbackURL: "http://127.0.0.1/hook"}
+	if err := jobRepo.Create(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := deliveryRepo.Create(&models.WebhookDelivery{JobID: job.JobID, URL: job.CallbackURL, Attempt: 1, Success: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.removeJob(job) {
+		t.Fatal("removeJob() = false")
+	}
+	if deliveries, err := deliveryRepo.FindByJobID(job.JobID); err != nil || len(deliveries) != 0 {
+		t.Errorf("webhook deliveries after removal = %d (err %v), want 0", len(deliveries), err)
+	}
+	if transitions, err := jobRepo.FindTransitions(job.JobID); err != nil || len(transitions) != 0 {
+		t.Errorf("transitions after removal = %d (err %v), want 0", len(transitions), err)
+	}
+}
+
+func TestRetentionRemoveJobDeletesEmptyBatch(t *testing.T) {
+	engine := newTestEngine(t)
+	jobRepo := repositories.NewXormJobRepository(engine)
+	batchRepo := repositories.NewXormJobBatchRepository(engine)
+	s := &retentionServiceImpl{jobRepo: jobRepo}
+
+	if err := batchRepo.Create(&models.JobBatch{BatchID: "batch_a", UserID: 1, Total: 2}); err != nil {
+		t.Fatal(err)
+	}
+	var jobs []*models.Job
+	for _, jobID := range []string{"job_a1", "job_a2"} {
+		job := &models.Job{JobID: jobID, UserID: 1, BatchID: "batch_a", Status: models.TaskSucceeded}
+		if err := jobRepo.Create(job); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	// 批次中还有任务时保留批次
+	s.removeJob(jobs[0])
+	if batch, err := batchRepo.FindByBatchIDForUser("batch_a", 1); err != nil || batch == nil {
+		t.Fatalf("batch after removing one of two jobs = %v (err %v), want kept", batch, err)
+	}
+
+	s.removeJob(jobs[1])
+	if batch, err := batchRepo.FindByBatchIDForUser("batch_a", 1); err != nil || batch != nil {
+		t.Errorf("batch after removing all jobs = %v (err %v), want deleted", batch, err)
+	}
+}
+
+func TestRetentionDiskBudgetCountsInputImages(t *testing.T) {
+	jobRepo := repositories.NewXormJobRepository(newTestEngine(t))
+	dir, inputDir := t.TempDir(), t.TempDir()
+	s := &retentionServiceImpl{
+		jobRepo:      jobRepo,
+		dir:          dir,
+		inputDir:     inputDir,
+		maxDiskBytes: 150,
+	}
+
+	// GIF很小，输入图片占用了大部分空间，只统计任务目录时不会超出预算
+	var jobs []*models.Job
+	for _, jobID := range []string{"job_old", "job_new"} {
+		job := &models.Job{
+			JobID:          jobID,
+			Status:         models.TaskSucceeded,
+			OutputPath:     filepath.Join(dir, jobID+".gif"),
+			InputImagePath: filepath.Join(inputDir, jobID+".png"),
+		}
+		if err := os.WriteFile(job.OutputPath, make([]byte, 10), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(job.InputImagePath, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := jobRepo.Create(job); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	s.enforceDiskBudget()
+
+	for i, want := range []bool{false, true} {
+		job := jobs[i]
+		if _, err := os.Stat(job.InputImagePath); (err == nil) != want {
+			t.Errorf("%s input image exists = %v, want %v", job.JobID, err == nil, want)
+		}
+		if found, err := jobRepo.FindByJobIDForUser(job.JobID, job.UserID); err != nil || (found != nil) != want {
+			t.Errorf("%s record exists = %v (err %v), want %v", job.JobID, found != nil, err, want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"emoji-maker-backend/config"
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/repositories"
+)
+
+// Webhook请求头
+const (
+	WebhookSignatureHeader = "X-Emoji-Signature" // sha256=<HMAC-SHA256(secret, timestamp + "." + body)的十六进制>
+	WebhookTimestampHeader = "X-Emoji-Timestamp" // 签名时的Unix时间戳(秒)
+	WebhookEventHeader     = "X-Emoji-Event"
+	WebhookAttemptHeader   = "X-Emoji-Attempt"
+
+	webhookEventJobFinished = "job.finished"
+	webhookMaxBackoff       = 5 * time.Minute
+)
+
+// WebhookDispatcher 任务结束时向回调地址投递结果
+type WebhookDispatcher interface {
+	// Dispatch 任务进入终态且设置了回调地址时异步投递，可直接注册为JobEventBroker的监听函数
+	Dispatch(job models.Job)
+	// Stop 等待进行中的投递结束
+	Stop()
+}
+
+// webhookDispatcherImpl 带HMAC签名、失败重试和投递日志的回调投递实现
+type webhookDispatcherImpl struct {
+	deliveryRepo   repositories.WebhookDeliveryRepository
+	client         *http.Client
+	secret         []byte
+	maxAttempts    int
+	initialBackoff time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWebhookDispatcher 创建回调投递实例，未配置签名密钥时不投递回调，创建任务时也不接受回调地址
+func NewWebhookDispatcher(deliveryRepo repositories.WebhookDeliveryRepository) WebhookDispatcher {
+	cfg := config.AppConfig.Webhook
+	if cfg.Secret == "" {
+		log.Printf("未配置webhook.secret，任务结束回调已禁用")
+	}
+	return &webhookDispatcherImpl{
+		deliveryRepo:   deliveryRepo,
+		client:         newWebhookClient(cfg.Timeout, cfg.AllowPrivateHosts),
+		secret:         []byte(cfg.Secret),
+		maxAttempts:    cfg.MaxAttempts,
+		initialBackoff: cfg.InitialBackoff,
+		stop:           make(chan struct{}),
+	}
+}
+
+// newWebhookClient 创建投递回调的HTTP客户端
+// 回调地址由用户提供，默认在建立连接时检查解析后的地址，拒绝连接回环、内网和链路本地地址，
+// 域名解析到内网地址(包括DNS重新绑定)以及跳转到内网地址的情况都会被拒绝；回调请求不经过代理，否则检查的是代理的地址
+func newWebhookClient(timeout time.Duration, allowPrivateHosts bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	if !allowPrivateHosts {
+		dialer.Control = rejectPrivateAddress
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// rejectPrivateAddress 在连接建立前检查目标地址，作为net.Dialer的Control使用
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivateIP(ip) {
+		return fmt.Errorf("callback to private address %s is not allowed", host)
+	}
+	return nil
+}
+
+// sharedAddressSpace 运营商级NAT使用的地址段(100.64.0.0/10)，部分云服务的元数据服务也在该地址段内
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPrivateIP 是否为回环、内网、链路本地等不允许回调的地址
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// Dispatch 任务进入终态时异步投递回调
+func (d *webhookDispatcherImpl) Dispatch(job models.Job) {
+	if job.CallbackURL == "" || !job.IsTerminal() {
+		return
+	}
+	if len(d.secret) == 0 {
+		// 空密钥的签名任何人都能伪造，不投递
+		log.Printf("未配置webhook.secret，不投递任务 %s 的回调", job.JobID)
+		return
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(&job)
+	}()
+}
+
+// Stop 停止重试等待并等待进行中的投递结束
+func (d *webhookDispatcherImpl) Stop() {
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// deliver 投递回调，失败时按指数退避重试，每次尝试都记录投递日志
+func (d *webhookDispatcherImpl) deliver(job *models.Job) {
+	body, err := json.Marshal(NewQueryTaskResponse(job))
+	if err != nil {
+		log.Printf("序列化任务 %s 的回调内容失败: %v", job.JobID, err)
+		return
+	}
+
+	backoff := d.initialBackoff
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		delivery := d.post(job, body, attempt)
+		if err := d.deliveryRepo.Create(delivery); err != nil {
+			log.Printf("保存任务 %s 的回调投递记录失败: %v", job.JobID, err)
+		}
+		if delivery.Success {
+			return
+		}
+		if attempt == d.maxAttempts {
+			log.Printf("任务 %s 的回调在 %d 次尝试后仍然失败: %s", job.JobID, attempt, delivery.Error)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-d.stop:
+			return
+		}
+		backoff *= 2
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// post 发送一次回调请求，2xx响应视为成功
+func (d *webhookDispatcherImpl) post(job *models.Job, body []byte, attempt int) *models.WebhookDelivery {
+	delivery := &models.WebhookDelivery{
+		JobID:   job.JobID,
+		URL:     job.CallbackURL,
+		Status:  job.Status,
+		Attempt: attempt,
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequest("POST", job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, webhookEventJobFinished)
+	request.Header.Set(WebhookAttemptHeader, strconv.Itoa(attempt))
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(d.secret, timestamp, body))
+
+	start := time.Now()
+	response, err := d.client.Do(request)
+	delivery.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	delivery.StatusCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		delivery.Error = "unexpected status " + response.Status
+		return delivery
+	}
+	delivery.Success = true
+	return delivery
+}
+
+// SignWebhook 计算回调签名，接收方使用相同的密钥对请求头中的时间戳和原始请求体重新计算并比对
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateCallbackURL 校验回调地址，只允许http和https，未配置签名密钥时不接受回调地址，默认不接受内网IP
+func ValidateCallbackURL(callbackURL string) error {
+	if config.AppConfig.Webhook.Secret == "" {
+		return fmt.Errorf("callbacks are disabled because webhook.secret is not configured")
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback_url must use http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute URL")
+	}
+	// 直接写明的内网地址在创建时就拒绝，域名在投递建立连接时检查
+	if ip := net.ParseIP(u.Hostname()); ip != nil && isPrivateIP(ip) && !config.AppConfig.Webhook.AllowPrivateHosts {
+		return fmt.Errorf("callback_url must not point to a private or loopback address")
+	}
+	return nil
+}
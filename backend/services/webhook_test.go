@@ -0,0 +1,207 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"emoji-maker-backend/config"
+	"emoji-maker-backend/models"
+	"emoji-maker-backend/repositories"
+)
+
+// setWebhookConfig 设置回调配置，测试结束后恢复，测试的接收方在回环地址上，默认允许回调到内网地址
+func setWebhookConfig(t *testing.T, secret string) {
+	saved := config.AppConfig.Webhook
+	t.Cleanup(func() { config.AppConfig.Webhook = saved })
+	config.AppConfig.Webhook.Secret = secret
+	config.AppConfig.Webhook.MaxAttempts = 3
+	config.AppConfig.Webhook.Timeout = 5 * time.Second
+	config.AppConfig.Webhook.InitialBackoff = 10 * time.Millisecond
+	config.AppConfig.Webhook.AllowPrivateHosts = true
+}
+
+func TestWebhookDispatcherSignsAndRetries(t *testing.T) {
+	const secret = "test-secret"
+	setWebhookConfig(t, secret)
+
+	var (
+		mu       sync.Mutex
+		attempts int
+		verified bool
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// 第一次返回错误，验证会重试
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// 接收方按文档独立计算签名
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get(WebhookTimestampHeader) + "."))
+		mac.Write(body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if got := r.Header.Get(WebhookSignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+			t.Errorf("%s = %q, want %q", WebhookSignatureHeader, got, want)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if got := r.Header.Get(WebhookAttemptHeader); got != "2" {
+			t.Errorf("%s = %q, want 2", WebhookAttemptHeader, got)
+		}
+		var payload map[string]any
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("callback body is not JSON: %v", err)
+		}
+		verified = true
+	}))
+	defer receiver.Close()
+
+	deliveryRepo := repositories.NewXormWebhookDeliveryRepository(newTestEngine(t))
+	dispatcher := NewWebhookDispatcher(deliveryRepo)
+	job := models.Job{JobID: "job_hook", UserID: 1, Status: models.TaskSucceeded, CallbackURL: receiver.URL}
+	dispatcher.Dispatch(job)
+	// 非终态的任务不投递
+	dispatcher.Dispatch(models.Job{JobID: "job_running", Status: models.TaskRunning, CallbackURL: receiver.URL})
+	// Stop会中止重试等待，等第二次投递完成后再停止
+	waitFor(t, "the retried delivery", func() bool {
+		deliveries, _ := deliveryRepo.FindByJobID(job.JobID)
+		return len(deliveries) == 2
+	})
+	dispatcher.Stop()
+
+	mu.Lock()
+	if attempts != 2 || !verified {
+		t.Errorf("receiver got %d attempts (verified %v), want 2 with a valid signature", attempts, verified)
+	}
+	mu.Unlock()
+
+	deliveries, err := deliveryRepo.FindByJobID(job.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("recorded %d deliveries, want 2", len(deliveries))
+	}
+	for _, delivery := range deliveries {
+		wantSuccess := delivery.Attempt == 2
+		if delivery.Success != wantSuccess {
+			t.Errorf("delivery attempt %d success = %v, want %v (status %d, error %q)", delivery.Attempt, delivery.Success, wantSuccess, delivery.StatusCode, delivery.Error)
+		}
+	}
+}
+
+func TestWebhookDispatcherSkipsWithoutSecret(t *testing.T) {
+	setWebhookConfig(t, "")
+
+	called := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer receiver.Close()
+
+	if err := ValidateCallbackURL(receiver.URL); err == nil {
+		t.Error("ValidateCallbackURL() without webhook.secret error = nil, want error")
+	}
+
+	dispatcher := NewWebhookDispatcher(repositories.NewXormWebhookDeliveryRepository(newTestEngine(t)))
+	dispatcher.Dispatch(models.Job{JobID: "job_hook", Status: models.TaskSucceeded, CallbackURL: receiver.URL})
+	dispatcher.Stop()
+	if called {
+		t.Error("callback delivered with an empty webhook.secret")
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	setWebhookConfig(t, "test-secret")
+	config.AppConfig.Webhook.AllowPrivateHosts = false
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://example.com/hook", wantErr: false},
+		{url: "http://127.0.0.1:8080/hook", wantErr: true},
+		{url: "http://localhost:8080/hook", wantErr: false}, // 域名在建立连接时检查
+		{url: "ftp://example.com/hook", wantErr: true},
+		{url: "/hook", wantErr: true},
+		{url: "http://%zz", wantErr: true},
+		{url: "http://169.254.169.254/latest/meta-data", wantErr: true},
+		{url: "http://10.0.0.8/hook", wantErr: true},
+		{url: "http://[::1]:8080/hook", wantErr: true},
+		{url: "http://100.100.100.200/latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := ValidateCallbackURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateCallbackURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWebhookDispatcherRejectsPrivateAddresses(t *testing.T) {
+	setWebhookConfig(t, "test-secret")
+	config.AppConfig.Webhook.AllowPrivateHosts = false
+	config.AppConfig.Webhook.MaxAttempts = 1
+
+	var called atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called.Store(true)
+	}))
+	defer receiver.Close()
+
+	deliveryRepo := repositories.NewXormWebhookDeliveryRepository(newTestEngine(t))
+	dispatcher := NewWebhookDispatcher(deliveryRepo)
+	// 使用域名绕过创建时的检查，建立连接时仍会被拒绝
+	callbackURL := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+	dispatcher.Dispatch(models.Job{JobID: "job_hook", Status: models.TaskSucceeded, CallbackURL: callbackURL})
+	dispatcher.Stop()
+
+	if called.Load() {
+		t.Error("callback delivered to a loopback address")
+	}
+	deliveries, err := deliveryRepo.FindByJobID("job_hook")
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("recorded %d deliveries (err %v), want 1", len(deliveries), err)
+	}
+	if delivery := deliveries[0]; delivery.Success || !strings.Contains(delivery.Error, "not allowed") {
+		t.Errorf("delivery = %+v, want a rejected connection", delivery)
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"100.100.100.200": true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fe80::1":         true,
+		"fd00::1":         true,
+		"::ffff:10.0.0.1": true,
+		"8.8.8.8":         false,
+		"2001:4860::8888": false,
+	}
+	for addr, want := range tests {
+		if got := isPrivateIP(net.ParseIP(addr)); got != want {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}